@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/scraperwiki/seaeye/pkg/seaeye"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultServerURL = "http://localhost:19515"
+
+// clientConfig specifies the ~/.seaeyerc client configuration file.
+type clientConfig struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token"`
+}
+
+// clientFlags holds the flags common to all client commands.
+type clientFlags struct {
+	server string
+	token  string
+	json   bool
+}
+
+func newClientFlagSet(name, args, desc string) (*flag.FlagSet, *clientFlags) {
+	cf := &clientFlags{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&cf.server, "server", "", "Server URL (default: $SEAEYE_SERVER, ~/.seaeyerc, or "+defaultServerURL+")")
+	fs.StringVar(&cf.token, "token", "", "API token (default: $SEAEYE_TOKEN or ~/.seaeyerc)")
+	fs.BoolVar(&cf.json, "json", false, "Print JSON instead of a table")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: seaeye %s [OPTION]... %s\n", name, args)
+		fmt.Fprintln(os.Stderr, desc)
+		fmt.Fprintln(os.Stderr)
+		fs.PrintDefaults()
+	}
+	return fs, cf
+}
+
+// client creates an API client given flags, environment variables, and the
+// client configuration file, in that order of precedence.
+func (cf *clientFlags) client() (*seaeye.Client, error) {
+	var conf clientConfig
+	if home := os.Getenv("HOME"); home != "" {
+		b, err := ioutil.ReadFile(filepath.Join(home, ".seaeyerc"))
+		if err == nil {
+			if err := yaml.Unmarshal(b, &conf); err != nil {
+				return nil, fmt.Errorf("failed to parse ~/.seaeyerc: %v", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	c := &seaeye.Client{
+		BaseURL: firstNonEmpty(cf.server, os.Getenv("SEAEYE_SERVER"), conf.Server, defaultServerURL),
+		Token:   firstNonEmpty(cf.token, os.Getenv("SEAEYE_TOKEN"), conf.Token),
+	}
+	return c, nil
+}
+
+func buildsCmd(args []string) int {
+	fs, cf := newClientFlagSet("builds", "", "List recent builds of a seaeye server.")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	return withClient(cf, func(c *seaeye.Client) error {
+		infos, err := c.Builds()
+		if err != nil {
+			return err
+		}
+		if cf.json {
+			return printJSON(infos)
+		}
+		printBuilds(infos...)
+		return nil
+	})
+}
+
+func logsCmd(args []string) int {
+	var followFlag bool
+	fs, cf := newClientFlagSet("logs", "BUILD", "Print the log of a build.")
+	fs.BoolVar(&followFlag, "f", false, "Follow the log until the build finished")
+	fs.Parse(args)
+	id, ok := buildArg(fs)
+	if !ok {
+		return 2
+	}
+
+	return withClient(cf, func(c *seaeye.Client) error {
+		return c.Log(id, followFlag, os.Stdout)
+	})
+}
+
+func triggerCmd(args []string) int {
+	fs, cf := newClientFlagSet("trigger", "OWNER/REPO REF", "Trigger a build of a repository at a branch, tag, or commit.")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	return withClient(cf, func(c *seaeye.Client) error {
+		info, err := c.Trigger(fs.Arg(0), fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		if cf.json {
+			return printJSON(info)
+		}
+		printBuilds(info)
+		return nil
+	})
+}
+
+func cancelCmd(args []string) int {
+	fs, cf := newClientFlagSet("cancel", "BUILD", "Cancel a pending or running build.")
+	fs.Parse(args)
+	id, ok := buildArg(fs)
+	if !ok {
+		return 2
+	}
+
+	return withClient(cf, func(c *seaeye.Client) error {
+		info, err := c.Cancel(id)
+		if err != nil {
+			return err
+		}
+		if cf.json {
+			return printJSON(info)
+		}
+		printBuilds(info)
+		return nil
+	})
+}
+
+func withClient(cf *clientFlags, f func(c *seaeye.Client) error) int {
+	c, err := cf.client()
+	if err == nil {
+		err = f(c)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "seaeye: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func buildArg(fs *flag.FlagSet) (int, bool) {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 0, false
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "seaeye: invalid build %q\n", fs.Arg(0))
+		return 0, false
+	}
+	return id, true
+}
+
+func printBuilds(infos ...*seaeye.BuildInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREPO\tREV\tSTATE\tCREATED\tDURATION")
+	for _, i := range infos {
+		rev := i.Rev
+		if len(rev) > 12 {
+			rev = rev[:12]
+		}
+		var duration string
+		if i.Started != nil {
+			end := time.Now()
+			if i.Finished != nil {
+				end = *i.Finished
+			}
+			duration = (end.Sub(*i.Started) / time.Second * time.Second).String()
+		}
+		fmt.Fprintf(w, "%d\t%s/%s\t%s\t%s\t%s\t%s\n", i.ID, i.Owner, i.Repo, rev, i.State,
+			i.Created.Local().Format("2006-01-02 15:04:05"), duration)
+	}
+	w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/scraperwiki/seaeye/pkg/seaeye"
+)
+
+func encryptCmd(args []string) int {
+	var keyFlag, repoFlag string
+	fs, cf := newClientFlagSet("encrypt", "-repo OWNER/REPO [VALUE]",
+		"Encrypt a secret for the secrets section of a repository's manifest.\n"+
+			"Without VALUE, the secret is read from standard input.")
+	fs.StringVar(&keyFlag, "key", "", "Public key file to encrypt with instead of the server's")
+	fs.StringVar(&repoFlag, "repo", "", "Repository the secret is for")
+	fs.Parse(args)
+	if fs.NArg() > 1 || strings.Count(repoFlag, "/") != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	value := fs.Arg(0)
+	if fs.NArg() == 0 {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "seaeye: failed to read secret: %v\n", err)
+			return 1
+		}
+		value = strings.TrimSuffix(string(b), "\n")
+	}
+
+	return withClient(cf, func(c *seaeye.Client) error {
+		var pub *rsa.PublicKey
+		var err error
+		if keyFlag != "" {
+			var b []byte
+			if b, err = ioutil.ReadFile(keyFlag); err == nil {
+				pub, err = seaeye.ParsePublicKeyPEM(b)
+			}
+		} else {
+			pub, err = c.PublicKey()
+		}
+		if err != nil {
+			return err
+		}
+
+		secret, err := seaeye.EncryptSecret(pub, repoFlag, value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(secret)
+		return nil
+	})
+}
@@ -17,14 +17,33 @@ func init() {
 	}
 }
 
+var cmdLog = seaeye.ServerLog.Named("cmd")
+
+// configFlag holds the path of the configuration file, if any.
+var configFlag string
+
 func main() {
 	var versionFlag bool
 
+	flag.StringVar(&configFlag, "config", "", "Read the configuration from a YAML file")
 	flag.BoolVar(&versionFlag, "v", false, "Show version information and exit")
 	flag.Usage = func() {
-		fmt.Fprintln(os.Stderr, "Usage: seaeye [OPTION]...")
+		fmt.Fprintln(os.Stderr, "Usage: seaeye [OPTION]... [COMMAND]")
 		fmt.Fprintln(os.Stderr, "Simple continuous integration server.")
 		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  run [DIR]                Run the pipeline of a local checkout")
+		fmt.Fprintln(os.Stderr, "  validate [PATH]          Validate the manifest of a checkout or a manifest file")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "  builds                   List recent builds of a server")
+		fmt.Fprintln(os.Stderr, "  logs [-f] BUILD          Print the log of a build")
+		fmt.Fprintln(os.Stderr, "  trigger OWNER/REPO REF   Trigger a build")
+		fmt.Fprintln(os.Stderr, "  cancel BUILD             Cancel a build")
+		fmt.Fprintln(os.Stderr, "  encrypt -repo OWNER/REPO Encrypt a manifest secret")
+		fmt.Fprintln(os.Stderr, "  secrets list|set|delete  Manage the secrets stored on a server")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Without command, the server is started.")
+		fmt.Fprintln(os.Stderr)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -34,28 +53,55 @@ func main() {
 		return
 	}
 
-	mainCmd()
+	switch flag.Arg(0) {
+	case "":
+		mainCmd()
+	case "builds":
+		os.Exit(buildsCmd(flag.Args()[1:]))
+	case "cancel":
+		os.Exit(cancelCmd(flag.Args()[1:]))
+	case "encrypt":
+		os.Exit(encryptCmd(flag.Args()[1:]))
+	case "logs":
+		os.Exit(logsCmd(flag.Args()[1:]))
+	case "secrets":
+		os.Exit(secretsCmd(flag.Args()[1:]))
+	case "trigger":
+		os.Exit(triggerCmd(flag.Args()[1:]))
+	case "run":
+		os.Exit(runCmd(flag.Args()[1:]))
+	case "validate":
+		os.Exit(validateCmd(flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "seaeye: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
 }
 
 func mainCmd() {
 	log.SetPrefix("seaeye ")
 
-	config := seaeye.NewConfig()
+	config, err := seaeye.NewConfig(configFlag)
+	if err != nil {
+		cmdLog.Errorf("Failed to load configuration: %v", err)
+		os.Exit(1)
+	}
 	config.Version = version
 
-	a := &seaeye.App{Config: config}
+	a := &seaeye.App{Config: config, ConfigPath: configFlag}
 
-	log.Println("[I][cmd] Starting")
+	cmdLog.Infof("Starting")
 	if err := a.Start(); err != nil {
 		os.Exit(1)
 	}
-	log.Println("[I][cmd] Started")
+	cmdLog.Infof("Started")
 
 	a.WaitForSignals()
 
-	log.Println("[I][cmd] Stopping")
+	cmdLog.Infof("Stopping")
 	if err := a.Stop(); err != nil {
 		os.Exit(1)
 	}
-	log.Println("[I][cmd] Stopped")
+	cmdLog.Infof("Stopped")
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/scraperwiki/seaeye/pkg/seaeye"
+	"golang.org/x/net/context"
+)
+
+// runCmd runs the pipeline of a local checkout like the server would, without
+// fetching or notifying Github, and returns the exit code.
+func runCmd(args []string) int {
+	var jobFlag string
+	var noColorFlag bool
+
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.StringVar(&jobFlag, "job", "", "Job name as owner/repo, selecting SEAEYE_<JOB>_ overrides (default: from origin remote)")
+	fs.BoolVar(&noColorFlag, "no-color", false, "Disable colored output")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: seaeye run [OPTION]... [DIR]")
+		fmt.Fprintln(os.Stderr, "Run the pipeline of the checkout in DIR (default: current directory).")
+		fmt.Fprintln(os.Stderr)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	dir := "."
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	} else if fs.NArg() == 1 {
+		dir = fs.Arg(0)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "seaeye: %v\n", err)
+		return 1
+	}
+
+	manifestPath, err := seaeye.FindManifestFile(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "seaeye: %s: %v\n", dir, err)
+		return 1
+	}
+	m, err := seaeye.ReadManifest(manifestPath)
+	if errs, ok := err.(seaeye.ManifestErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, manifestErrorLine(manifestPath, e))
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "seaeye: %s: %v\n", manifestPath, err)
+		return 1
+	}
+
+	if jobFlag == "" {
+		jobFlag = jobFromGitRemote(dir)
+	}
+	parts := strings.SplitN(jobFlag, "/", 2)
+	if len(parts) != 2 {
+		parts = []string{"local", jobFlag}
+	}
+
+	config, err := seaeye.NewConfig(configFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "seaeye: %v\n", err)
+		return 1
+	}
+	config.Version = version
+
+	color := !noColorFlag && isTerminal(os.Stdout)
+	j := &seaeye.Job{
+		Config:   config,
+		Fetcher:  &seaeye.LocalFetcher{Dir: dir},
+		Logger:   seaeye.NewTerminalLogger(os.Stdout, "", log.Ltime),
+		Manifest: m,
+		Notifier: &seaeye.TerminalNotifier{Writer: os.Stdout, Color: color},
+	}
+	s := &seaeye.Source{
+		Owner: parts[0],
+		Repo:  parts[1],
+		Rev:   firstNonEmpty(gitOutput(dir, "rev-parse", "HEAD"), "local"),
+		URL:   dir,
+		Ref:   gitOutput(dir, "symbolic-ref", "-q", "HEAD"),
+	}
+
+	// Cancel on Ctrl-c so the Cleanup stage still gets to run.
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	if err := j.ExecuteContext(ctx, s); err != nil {
+		return 1
+	}
+	return 0
+}
+
+var githubRemotePattern = regexp.MustCompile(`github\.com[:/]([^/]+)/(.+?)(\.git)?/?$`)
+
+// jobFromGitRemote derives owner/repo from the origin remote URL of a checkout,
+// falling back to the directory name.
+func jobFromGitRemote(dir string) string {
+	if m := githubRemotePattern.FindStringSubmatch(gitOutput(dir, "config", "--get", "remote.origin.url")); m != nil {
+		return m[1] + "/" + m[2]
+	}
+	return filepath.Base(dir)
+}
+
+// gitOutput runs a git command in dir and returns its trimmed output, or an
+// empty string if it failed.
+func gitOutput(dir string, args ...string) string {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/scraperwiki/seaeye/pkg/seaeye"
+)
+
+func secretsCmd(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "Usage: seaeye secrets list|set|delete [OPTION]... [ARG]...")
+		fmt.Fprintln(os.Stderr, "Manage the secrets stored on a seaeye server.")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	switch args[0] {
+	case "list":
+		return secretsListCmd(args[1:])
+	case "set":
+		return secretsSetCmd(args[1:])
+	case "delete":
+		return secretsDeleteCmd(args[1:])
+	default:
+		return usage()
+	}
+}
+
+func secretsListCmd(args []string) int {
+	fs, cf := newClientFlagSet("secrets list", "[SCOPE]",
+		"List the names of the secrets of a scope (\"\", OWNER, or OWNER/REPO), or of all scopes.")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	scope := "*"
+	if fs.NArg() == 1 {
+		scope = fs.Arg(0)
+	}
+
+	return withClient(cf, func(c *seaeye.Client) error {
+		infos, err := c.Secrets(scope)
+		if err != nil {
+			return err
+		}
+		if cf.json {
+			return printJSON(infos)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SCOPE\tNAME\tUPDATED")
+		for _, i := range infos {
+			scope := i.Scope
+			if scope == "" {
+				scope = "(global)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", scope, i.Name, i.Updated.Local().Format("2006-01-02 15:04:05"))
+		}
+		return w.Flush()
+	})
+}
+
+func secretsSetCmd(args []string) int {
+	var scopeFlag string
+	fs, cf := newClientFlagSet("secrets set", "NAME [VALUE]",
+		"Add or replace a secret. Without VALUE, the secret is read from standard input.")
+	fs.StringVar(&scopeFlag, "scope", "", "OWNER or OWNER/REPO the secret is for (default: global)")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	value := fs.Arg(1)
+	if fs.NArg() == 1 {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "seaeye: failed to read secret: %v\n", err)
+			return 1
+		}
+		value = strings.TrimSuffix(string(b), "\n")
+	}
+
+	return withClient(cf, func(c *seaeye.Client) error {
+		info, err := c.SetSecret(scopeFlag, fs.Arg(0), value)
+		if err != nil {
+			return err
+		}
+		if cf.json {
+			return printJSON(info)
+		}
+		return nil
+	})
+}
+
+func secretsDeleteCmd(args []string) int {
+	var scopeFlag string
+	fs, cf := newClientFlagSet("secrets delete", "NAME", "Delete a secret.")
+	fs.StringVar(&scopeFlag, "scope", "", "OWNER or OWNER/REPO the secret is for (default: global)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	return withClient(cf, func(c *seaeye.Client) error {
+		return c.DeleteSecret(scopeFlag, fs.Arg(0))
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/scraperwiki/seaeye/pkg/seaeye"
+)
+
+// validateCmd validates a manifest given either a checkout directory or a
+// manifest file, printing all errors found, and returns the exit code.
+func validateCmd(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: seaeye validate [PATH]")
+		fmt.Fprintln(os.Stderr, "Validate the .seaeye.yml manifest in PATH (default: current directory),")
+		fmt.Fprintln(os.Stderr, "or the manifest file PATH.")
+	}
+	fs.Parse(args)
+
+	p := "."
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	} else if fs.NArg() == 1 {
+		p = fs.Arg(0)
+	}
+
+	manifestPath := p
+	if fi, err := os.Stat(p); err != nil {
+		fmt.Fprintf(os.Stderr, "seaeye: %v\n", err)
+		return 1
+	} else if fi.IsDir() {
+		manifestPath, err = seaeye.FindManifestFile(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "seaeye: %s: %v\n", p, err)
+			return 1
+		}
+	}
+
+	_, err := seaeye.ReadManifest(manifestPath)
+	if errs, ok := err.(seaeye.ManifestErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s\n", manifestErrorLine(manifestPath, e))
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "seaeye: %s: %v\n", manifestPath, err)
+		return 1
+	}
+
+	fmt.Printf("%s: OK\n", manifestPath)
+	return 0
+}
+
+// manifestErrorLine formats a manifest error in the common `file:line:column:`
+// notation understood by editors.
+func manifestErrorLine(manifestPath string, e *seaeye.ManifestError) string {
+	loc := manifestPath
+	if e.Line > 0 {
+		loc += fmt.Sprintf(":%d", e.Line)
+		if e.Column > 0 {
+			loc += fmt.Sprintf(":%d", e.Column)
+		}
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("%s: %s: %s", loc, e.Path, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", loc, e.Msg)
+}
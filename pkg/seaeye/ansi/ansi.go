@@ -13,6 +13,26 @@ var colors = []string{
 	"#686868", "#FF5959", "#00FF6B", "#FAFF5C", "#775AFF", "#FF47FE", "#0FFFFF", "#FFFFFF",
 }
 
+// Foreground colors.
+const (
+	Red    = 31
+	Green  = 32
+	Yellow = 33
+)
+
+// Colorize wraps text in escape codes to show it in a given color.
+func Colorize(color int, text string) string {
+	return fmt.Sprintf("\u001B[1;%dm%s\u001B[0m", color, text)
+}
+
+// escapeCode matches ANSI escape sequences, e.g. colors and cursor movement.
+var escapeCode = regexp.MustCompile("\u001B\\[[0-9;?]*[A-Za-z]")
+
+// Strip removes all ANSI escape sequences from text.
+func Strip(text []byte) []byte {
+	return escapeCode.ReplaceAll(text, nil)
+}
+
 func ToHTML(text []byte) []byte {
 	re := regexp.MustCompile("\u001B\\[([0-9A-Za-z;]+)m([^\u001B]+)")
 	matches := re.FindAllSubmatch(text, -1)
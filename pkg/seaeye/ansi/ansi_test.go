@@ -9,3 +9,7 @@ import (
 func TestToHTML(t *testing.T) {
 	assert.Equal(t, []byte(""), ToHTML([]byte("")))
 }
+
+func TestStrip(t *testing.T) {
+	assert.Equal(t, "ok: done\n", string(Strip([]byte(Colorize(Green, "ok")+": \u001B[2Kdone\n"))))
+}
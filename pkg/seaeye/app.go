@@ -1,10 +1,10 @@
 package seaeye
 
 import (
-	"log"
 	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -13,94 +13,174 @@ import (
 
 // App specifies an application state and lifecycle.
 type App struct {
-	Builds    *BuildQueue
-	Config    *Config
-	Hookbot   *HookbotTrigger
-	WebServer *Server
-	startTime time.Time
+	Builds *BuildQueue
+	Config *Config
+	// ConfigPath holds the path of the configuration file re-read on reload,
+	// if any.
+	ConfigPath  string
+	Hookbot     *HookbotTrigger
+	Janitor     *Janitor
+	SecretKey   *SecretKey
+	SecretStore *SecretStore
+	WebServer   *Server
+	credentials credentialsCheck
+	mu          sync.RWMutex // guards Config and Hookbot after Start
+	startTime   time.Time
 }
 
 // Stats contains statistics about the application.
 type Stats map[string]interface{}
 
-// Start starts the server: build > web > hookbot > signals.
+// Start starts the server: build > janitor > web > hookbot > signals.
 func (a *App) Start() error {
-	log.Println("[I][app] Starting")
+	if err := ServerLog.SetFormat(a.Config.LogFormat); err != nil {
+		return err
+	}
+	ServerLog.SetLevel(a.Config.LogLevel)
+	appLog.Infof("Starting")
 	if a.startTime.IsZero() {
 		a.startTime = time.Now()
 	}
 
+	if a.SecretKey == nil {
+		appLog.Infof("Loading secret key: %s", a.Config.SecretKeyPath)
+		k, err := LoadSecretKey(a.Config.SecretKeyPath)
+		if err != nil {
+			appLog.Errorf("Failed to load secret key: %v", err)
+			return err
+		}
+		a.SecretKey = k
+	}
+
+	if a.SecretStore == nil && a.Config.SecretStoreKey != "" {
+		appLog.Infof("Opening secret store: %s", a.Config.SecretStorePath)
+		s, err := OpenSecretStore(a.Config.SecretStorePath, a.Config.SecretStoreKey)
+		if err != nil {
+			appLog.Errorf("Failed to open secret store: %v", err)
+			return err
+		}
+		a.SecretStore = s
+	}
+
 	if a.Builds == nil {
-		log.Println("[I][app] Creating build queue")
-		a.Builds = &BuildQueue{
-			BuildCh: make(chan *Build, 50),
-			doneCh:  make(chan struct{}),
+		appLog.Infof("Creating build queue")
+		a.Builds = NewBuildQueue(a.Config.QueueCapacity)
+		a.Builds.Limit = func(s *Source) int {
+			return a.config().Repo(s.Owner, s.Repo).Concurrency
 		}
 	}
-	log.Printf("[I][app] Waiting for builds: %d", cap(a.Builds.BuildCh))
-	go waitForBuilds(a.Builds)
+	a.requeue()
+	appLog.Infof("Waiting for builds: %d, concurrency %d", a.Builds.Capacity, a.Config.Concurrency)
+	for i := 0; i < a.Config.Concurrency; i++ {
+		go waitForBuilds(a.Builds)
+	}
+
+	if a.Janitor == nil {
+		a.Janitor = &Janitor{Builds: a.Builds, Config: a.config}
+	}
+	appLog.Infof("Starting janitor, every %v", a.Config.JanitorInterval)
+	a.Janitor.Start()
 
 	if a.WebServer == nil {
-		log.Println("[I][app] Creating web server")
-		a.WebServer = NewWebServer(a.Config, a.Builds.BuildCh, a.stats)
+		appLog.Infof("Creating web server")
+		a.WebServer = NewWebServer(a.config, a.Builds, a.SecretKey, a.SecretStore, a.stats, a.readiness)
 	}
-	log.Printf("[I][app] Starting web server %s", a.WebServer.Addr)
+	appLog.Infof("Starting web server %s", a.WebServer.Addr)
 	if err := a.WebServer.Start(); err != nil {
-		log.Printf("[E][app] Failed to start web server: %v", err)
+		appLog.Errorf("Failed to start web server: %v", err)
 		return err
 	}
 
 	if a.Hookbot == nil {
-		log.Println("[I][app] Creating hookbot subscriber")
-		a.Hookbot = &HookbotTrigger{
-			Endpoint: a.Config.HookbotEndpoint,
-			Hook: func(event *github.PushEvent) error {
-				g := &GithubTrigger{}
-				url := &url.URL{Scheme: "http", Host: a.Config.HostPort, Path: "webhook"}
-				return g.Post(url.String(), event)
-			},
-		}
+		appLog.Infof("Creating hookbot subscriber")
+		a.Hookbot = a.newHookbot(a.Config.HookbotEndpoint)
 	}
-	log.Printf("[I][app] Starting hookbot subscriber: %s", a.Config.HookbotEndpoint)
+	appLog.Infof("Starting hookbot subscriber: %s", a.Config.HookbotEndpoint)
 	if err := a.Hookbot.Start(); err != nil {
-		log.Printf("[E][app] Failed to start hookbot subscriber: %v", err)
+		appLog.Errorf("Failed to start hookbot subscriber: %v", err)
 		return err
 	}
 
-	log.Println("[I][app] Started")
+	appLog.Infof("Started")
 	return nil
 }
 
-// Stop shuts down the server: hookbot > web > build.
+// Stop shuts down the server: hookbot > janitor > build > web. Running builds get the
+// configured shutdown timeout to finish. Builds canceled or never started are
+// reported as errored and requeued on the next start.
 func (a *App) Stop() error {
-	log.Println("[I][app] Stopping")
+	appLog.Infof("Stopping")
 
-	if a.Hookbot != nil {
-		log.Println("[I][app] Stopping hookbot subscriber")
-		a.Hookbot.Stop()
+	a.mu.Lock()
+	h := a.Hookbot
+	a.Hookbot = nil
+	a.mu.Unlock()
+	if h != nil {
+		appLog.Infof("Stopping hookbot subscriber")
+		h.Stop()
+	}
+
+	if a.Janitor != nil {
+		appLog.Infof("Stopping janitor")
+		a.Janitor.Stop()
+	}
+
+	if a.Builds != nil {
+		c := a.config()
+		appLog.Infof("Shutting down build queue, waiting up to %v for running builds", c.ShutdownTimeout)
+		interrupted := a.Builds.Shutdown(c.ShutdownTimeout)
+		for _, b := range interrupted {
+			buildLog(appLog, b).Warnf("Build %d interrupted", b.ID)
+			if err := b.Job.Abort(b.Source, ShutdownDescription); err != nil {
+				buildLog(appLog, b).Errorf("Failed to notify about interrupted build %d: %v", b.ID, err)
+			}
+		}
+		if len(interrupted) > 0 {
+			appLog.Infof("Saving %d interrupted builds: %s", len(interrupted), c.QueueFile)
+			if err := SaveSources(c.QueueFile, interrupted); err != nil {
+				appLog.Errorf("Failed to save interrupted builds: %v", err)
+			}
+		}
 	}
 
 	if a.WebServer != nil {
-		log.Println("[I][app] Stopping web server")
+		appLog.Infof("Stopping web server")
 		if err := a.WebServer.Stop(); err != nil {
-			log.Printf("[E][app] Failed to stop web server: %v", err)
+			appLog.Errorf("Failed to stop web server: %v", err)
 			return err
 		}
 	}
 
-	if a.Builds != nil {
-		log.Println("[I][app] Closing build queue")
-		a.Builds.doneCh <- struct{}{}
-	}
-
-	log.Println("[I][app] Stopped")
+	appLog.Infof("Stopped")
 	return nil
 }
 
+// requeue enqueues the builds interrupted by the last shutdown.
+func (a *App) requeue() {
+	sources, err := LoadSources(a.Config.QueueFile)
+	if err != nil {
+		appLog.Errorf("Failed to load interrupted builds: %v", err)
+		return
+	}
+	for _, s := range sources {
+		if !a.Config.Allowed(s) {
+			appLog.With(sourceFields(s)...).Infof("Not requeuing build not allowlisted: %#v", s)
+			continue
+		}
+		j := &Job{Config: a.Config, SecretKey: a.SecretKey, SecretStore: a.SecretStore}
+		b, err := a.Builds.Enqueue(j, s)
+		if err != nil {
+			appLog.With(sourceFields(s)...).Errorf("Failed to requeue build: %v", err)
+			continue
+		}
+		buildLog(appLog, b).Infof("Requeued interrupted build: build %d", b.ID)
+	}
+}
+
 // WaitForSignals listens looping for syscall signals until SIGINT or SIGTERM is
 // provided.
 func (a *App) WaitForSignals() {
-	log.Println("[I][app] Waiting for signals")
+	appLog.Infof("Waiting for signals")
 	sigc := make(chan os.Signal, 6)
 	signal.Notify(sigc,
 		syscall.SIGUSR1, // syscall.SIGINFO, // BSD only
@@ -112,8 +192,7 @@ func (a *App) WaitForSignals() {
 		case // syscall.SIGINFO, // Ctrl-t
 			syscall.SIGUSR1:
 			a.printStats()
-		case syscall.SIGHUP,
-			syscall.SIGUSR2:
+		case syscall.SIGHUP, syscall.SIGUSR2:
 			a.reload()
 		case syscall.SIGINT, // Ctrl-c
 			syscall.SIGTERM:
@@ -123,24 +202,120 @@ func (a *App) WaitForSignals() {
 	}
 }
 
+func (a *App) newHookbot(endpoint string) *HookbotTrigger {
+	return &HookbotTrigger{
+		Endpoint: endpoint,
+		Hook: func(event *github.PushEvent) error {
+			g := &GithubTrigger{}
+			url := &url.URL{Scheme: "http", Host: a.config().HostPort, Path: "webhook"}
+			return g.Post(url.String(), event)
+		},
+	}
+}
+
+// config returns the current configuration.
+func (a *App) config() *Config {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.Config
+}
+
+// hookbot returns the current hookbot subscriber, nil once stopped.
+func (a *App) hookbot() *HookbotTrigger {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.Hookbot
+}
+
+// reload re-reads the configuration and swaps it for the current one, unless
+// it is invalid. Builds already queued or running keep the configuration they
+// were queued with. Settings bound to resources acquired at start keep their
+// values until restart.
 func (a *App) reload() {
-	log.Println("[I][app] Reloading")
-	// TODO(uwe): Do reloading
+	appLog.Infof("Reloading")
+	old := a.config()
+	c, err := NewConfig(a.ConfigPath)
+	if err != nil {
+		appLog.Errorf("Failed to reload, keeping current configuration: %v", err)
+		return
+	}
+	c.Version = old.Version
+
+	changes := old.diff(c)
+	if len(changes) == 0 {
+		appLog.Infof("Reloaded: configuration unchanged")
+		return
+	}
+	for _, change := range changes {
+		if containsString(restartConfigKeys, change.Key) {
+			appLog.Warnf("Reload ignores %s, restart to apply", change)
+		} else {
+			appLog.Infof("Reload changes %s", change)
+		}
+	}
+	c.keepRestartSettings(old)
+
+	a.mu.Lock()
+	a.Config = c
+	a.mu.Unlock()
+	a.Builds.SetCapacity(c.QueueCapacity)
+	if c.LogFormat != old.LogFormat {
+		_ = ServerLog.SetFormat(c.LogFormat)
+	}
+	if c.LogLevel != old.LogLevel {
+		ServerLog.SetLevel(c.LogLevel)
+	}
+
+	if old := a.hookbot(); old != nil && c.HookbotEndpoint != old.Endpoint {
+		appLog.Infof("Restarting hookbot subscriber: %s", c.HookbotEndpoint)
+		old.Stop()
+		h := a.newHookbot(c.HookbotEndpoint)
+		if err := h.Start(); err != nil {
+			appLog.Errorf("Failed to start hookbot subscriber: %v", err)
+		}
+		a.mu.Lock()
+		if a.Hookbot == old {
+			a.Hookbot = h
+			h = nil
+		}
+		a.mu.Unlock()
+		if h != nil { // stopped meanwhile
+			h.Stop()
+		}
+	}
+	appLog.Infof("Reloaded")
+}
+
+// readiness checks that the server is able to receive and run builds.
+func (a *App) readiness() *Readiness {
+	c, h := a.config(), a.hookbot()
+
+	r := &Readiness{Ready: true}
+	if h != nil && c.HookbotEndpoint != "" {
+		r.add("hookbot", h.Connected())
+	}
+	r.add("workspace", checkDir(c.FetchBaseDir, c.MinFreeMB))
+	r.add("logs", checkDir(c.LogBaseDir, c.MinFreeMB))
+	r.add("workers", checkWorkers(a.Builds, c.HeartbeatTimeout))
+	if c.GithubToken != "" && !c.NoNotify {
+		r.add("github", a.credentials.check(c.GithubToken))
+	}
+	return r
 }
 
 func (a *App) printStats() {
 	stats := a.stats()
 	for k, v := range stats {
-		log.Printf("[I][app] Stats %s: %v", k, v)
+		appLog.Infof("Stats %s: %v", k, v)
 	}
 }
 
 func (a *App) stats() Stats {
 	return map[string]interface{}{
-		"/app/build_queue/count":        len(a.Builds.BuildCh),
+		"/app/build_queue/count":        a.Builds.Len(),
 		"/app/start_time":               a.startTime,
 		"/app/uptime":                   time.Now().Sub(a.startTime),
-		"/app/version":                  a.Config.Version,
+		"/app/version":                  a.config().Version,
 		"/webserver/active_connections": a.WebServer.ConnActive,
 	}
 }
@@ -1,30 +1,504 @@
 package seaeye
 
-import "log"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
 
-// BuildQueue specifies a sequential queue of pending builds.
+	"golang.org/x/net/context"
+)
+
+// Build states in addition to the commit states success, failure, and error.
+const (
+	BuildQueued   = "queued"
+	BuildRunning  = "running"
+	BuildCanceled = "canceled"
+)
+
+const maxRecentBuilds = 200
+
+// heartbeatInterval defines how often idle workers report being alive.
+const heartbeatInterval = 30 * time.Second
+
+// shutdownCancelGrace defines how long shutting down waits for canceled builds
+// to run their cleanup commands.
+const shutdownCancelGrace = time.Minute
+
+// ShutdownDescription describes builds interrupted by shutting down.
+const ShutdownDescription = "seaeye shutting down"
+
+var (
+	// ErrQueueFull defines that no more builds can be enqueued.
+	ErrQueueFull = errors.New("build queue full")
+	// ErrBuildNotFound defines that a build is unknown.
+	ErrBuildNotFound = errors.New("build not found")
+	// ErrBuildFinished defines that a build can't be canceled anymore.
+	ErrBuildFinished = errors.New("build already finished")
+	// ErrShuttingDown defines that no more builds are accepted.
+	ErrShuttingDown = errors.New(ShutdownDescription)
+)
+
+// BuildQueue specifies a queue of pending builds, run in order by any number of
+// workers. It keeps track of the most recent builds.
 type BuildQueue struct {
-	BuildCh chan *Build
-	doneCh  chan struct{}
+	Capacity int
+	// Limit returns the maximum number of builds of a source's repository
+	// running at once. If nil, builds of a repository run sequentially.
+	Limit      func(s *Source) int
+	active     sync.WaitGroup // running builds
+	closed     bool
+	doneCh     chan struct{}
+	heartbeats []time.Time // by worker
+	mu         sync.Mutex
+	nextID     int
+	notifyCh   chan struct{}
+	pending    []*Build
+	recent     []*Build
+	running    map[string]int // by owner/repo
 }
 
 // Build specifies a specific build for a job given a github push event as
 // parameter.
 type Build struct {
-	Job    *Job
-	Source *Source
+	ID       int
+	Job      *Job
+	Source   *Source
+	State    string
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+	cancel   context.CancelFunc
+	ctx      context.Context
+	// interrupted records that the build got canceled by shutting down.
+	interrupted bool
+}
+
+// BuildInfo describes a build for API responses.
+type BuildInfo struct {
+	ID       int        `json:"id"`
+	Owner    string     `json:"owner"`
+	Repo     string     `json:"repo"`
+	Rev      string     `json:"rev"`
+	Ref      string     `json:"ref,omitempty"`
+	State    string     `json:"state"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// NewBuildQueue creates a new build queue holding up to capacity pending
+// builds.
+func NewBuildQueue(capacity int) *BuildQueue {
+	return &BuildQueue{
+		Capacity: capacity,
+		doneCh:   make(chan struct{}),
+		nextID:   1,
+		notifyCh: make(chan struct{}, capacity+1),
+		running:  map[string]int{},
+	}
+}
+
+// Shutdown stops accepting builds and starting pending ones, and waits up to
+// timeout for the running builds to finish before canceling them. It returns
+// the builds that didn't finish, running ones first, all marked as errored.
+func (q *BuildQueue) Shutdown(timeout time.Duration) []*Build {
+	q.mu.Lock()
+	q.closed = true
+	close(q.doneCh)
+	q.mu.Unlock()
+
+	if !q.wait(timeout) {
+		q.mu.Lock()
+		for _, b := range q.recent {
+			if b.State == BuildRunning {
+				buildLog(appLog, b).Warnf("Canceling build %d", b.ID)
+				b.interrupted = true
+				b.cancel()
+			}
+		}
+		q.mu.Unlock()
+		if !q.wait(shutdownCancelGrace) {
+			appLog.Warnf("Canceled builds still running after %v", shutdownCancelGrace)
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var interrupted []*Build
+	for _, b := range q.recent {
+		if b.interrupted {
+			interrupted = append(interrupted, b)
+		}
+	}
+	interrupted = append(interrupted, q.pending...)
+	q.pending = nil
+	for _, b := range interrupted {
+		b.State = "error"
+		b.Finished = time.Now()
+	}
+	return interrupted
+}
+
+// wait waits up to timeout for all running builds to finish and returns if
+// they did.
+func (q *BuildQueue) wait(timeout time.Duration) bool {
+	doneCh := make(chan struct{})
+	go func() {
+		q.active.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// SetCapacity changes the maximum number of pending builds. Builds already
+// pending stay in the queue.
+func (q *BuildQueue) SetCapacity(capacity int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.Capacity = capacity
+}
+
+// wake notifies a waiting worker of a change to the queue.
+func (q *BuildQueue) wake() {
+	select {
+	case q.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue adds a new build for a job and source to the queue.
+func (q *BuildQueue) Enqueue(j *Job, s *Source) (*Build, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrShuttingDown
+	}
+	if len(q.pending) >= q.Capacity {
+		return nil, ErrQueueFull
+	}
+
+	b := &Build{
+		ID:      q.nextID,
+		Job:     j,
+		Source:  s,
+		State:   BuildQueued,
+		Created: time.Now(),
+	}
+	q.nextID++
+	j.BuildID = strconv.Itoa(b.ID)
+	q.pending = append(q.pending, b)
+	q.remember(b)
+
+	q.wake()
+	return b, nil
+}
+
+// Closed returns if the queue got shut down.
+func (q *BuildQueue) Closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// Heartbeats returns the time each worker last reported progress.
+func (q *BuildQueue) Heartbeats() []time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]time.Time{}, q.heartbeats...)
+}
+
+// addWorker registers a worker and returns its index.
+func (q *BuildQueue) addWorker() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.heartbeats = append(q.heartbeats, time.Now())
+	return len(q.heartbeats) - 1
+}
+
+func (q *BuildQueue) beat(worker int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.heartbeats[worker] = time.Now()
+}
+
+// Running returns the number of running builds.
+func (q *BuildQueue) Running() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, r := range q.running {
+		n += r
+	}
+	return n
+}
+
+// Len returns the number of pending builds.
+func (q *BuildQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Get returns a recent build by its id.
+func (q *BuildQueue) Get(id int) (*Build, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, b := range q.recent {
+		if b.ID == id {
+			return b, nil
+		}
+	}
+	return nil, ErrBuildNotFound
+}
+
+// List returns information about all recent builds, newest first.
+func (q *BuildQueue) List() []*BuildInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	infos := make([]*BuildInfo, 0, len(q.recent))
+	for i := len(q.recent) - 1; i >= 0; i-- {
+		infos = append(infos, q.recent[i].info())
+	}
+	return infos
+}
+
+// unlessActive runs f, holding off builds from starting, unless a queued or
+// running build matches. It reports whether f ran.
+func (q *BuildQueue) unlessActive(match func(b *Build) bool, f func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, b := range q.recent {
+		if (b.State == BuildQueued || b.State == BuildRunning) && match(b) {
+			return false
+		}
+	}
+	f()
+	return true
+}
+
+// Info returns information about a build.
+func (q *BuildQueue) Info(b *Build) *BuildInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return b.info()
+}
+
+// Cancel removes a pending build from the queue or cancels a running build.
+func (q *BuildQueue) Cancel(id int) (*Build, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, b := range q.pending {
+		if b.ID == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			b.State = BuildCanceled
+			b.Finished = time.Now()
+			return b, nil
+		}
+	}
+	for _, b := range q.recent {
+		if b.ID == id {
+			if b.State != BuildRunning {
+				return b, ErrBuildFinished
+			}
+			b.cancel()
+			return b, nil
+		}
+	}
+	return nil, ErrBuildNotFound
+}
+
+// Finished returns if a build is neither pending nor running.
+func (q *BuildQueue) Finished(b *Build) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return b.State != BuildQueued && b.State != BuildRunning
+}
+
+// remember records a build as recent build, forgetting the oldest finished
+// builds beyond maxRecentBuilds. Requires q.mu to be held.
+func (q *BuildQueue) remember(b *Build) {
+	q.recent = append(q.recent, b)
+	for i := 0; len(q.recent) > maxRecentBuilds && i < len(q.recent); {
+		if s := q.recent[i].State; s == BuildQueued || s == BuildRunning {
+			i++
+			continue
+		}
+		q.recent = append(q.recent[:i], q.recent[i+1:]...)
+	}
+}
+
+// next pops the first pending build whose repository is below its limit of
+// running builds and marks it running, or returns nil if there is none. Builds
+// of the same revision never run at once, as they share their log directory and
+// checkout.
+func (q *BuildQueue) next() *Build {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	var b *Build
+	for i, p := range q.pending {
+		limit := 1
+		if q.Limit != nil {
+			limit = q.Limit(p.Source)
+		}
+		if q.running[p.repo()] < limit && !q.revRunning(p) {
+			b = p
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	if b == nil {
+		return nil
+	}
+	q.running[b.repo()]++
+	q.active.Add(1)
+
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.State = BuildRunning
+	b.Started = time.Now()
+	return b
+}
+
+// revRunning decides if a build of the same revision as b is running.
+func (q *BuildQueue) revRunning(b *Build) bool {
+	for _, r := range q.recent {
+		if r.State == BuildRunning && r.repo() == b.repo() && r.Source.Rev == b.Source.Rev {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *BuildQueue) finish(b *Build, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b.Finished = time.Now()
+	switch {
+	case b.ctx.Err() != nil:
+		b.State = BuildCanceled
+	case err == nil:
+		b.State = "success"
+	case b.Job.result != "":
+		b.State = b.Job.result
+	default:
+		b.State = "error"
+	}
+	b.cancel()
+	metricBuilds.Inc(b.repo(), b.State)
+	metricBuildDuration.Observe(b.Finished.Sub(b.Started).Seconds(), b.repo(), b.State)
+
+	if q.running[b.repo()]--; q.running[b.repo()] == 0 {
+		delete(q.running, b.repo())
+	}
+	q.active.Done()
+	q.wake()
+}
+
+func (b *Build) repo() string {
+	return path.Join(b.Source.Owner, b.Source.Repo)
+}
+
+func (b *Build) info() *BuildInfo {
+	i := &BuildInfo{
+		ID:      b.ID,
+		Owner:   b.Source.Owner,
+		Repo:    b.Source.Repo,
+		Rev:     b.Source.Rev,
+		Ref:     b.Source.Ref,
+		State:   b.State,
+		Created: b.Created,
+	}
+	if !b.Started.IsZero() {
+		i.Started = &b.Started
+	}
+	if !b.Finished.IsZero() {
+		i.Finished = &b.Finished
+	}
+	return i
+}
+
+// LogFilePath returns the path of the build's log file.
+func (b *Build) LogFilePath(c *Config) (string, error) {
+	return c.LogFilePath(escapePath(path.Join(b.Source.Owner, b.Source.Repo)), b.Source.Rev)
+}
+
+// SaveSources writes the sources of builds to a file, to be read by
+// LoadSources.
+func SaveSources(path string, builds []*Build) error {
+	sources := make([]*Source, len(builds))
+	for i, b := range builds {
+		sources[i] = b.Source
+	}
+	data, err := json.MarshalIndent(sources, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// LoadSources reads and removes a file written by SaveSources. A missing file
+// holds no sources.
+func LoadSources(path string) ([]*Source, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sources []*Source
+	if err := json.Unmarshal(data, &sources); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return sources, os.Remove(path)
 }
 
 // waitForBuilds sequentially executes builds given a build source as parameter.
+// Running it multiple times runs builds concurrently. The worker beats while
+// idle and whenever its build starts or finishes a command.
 func waitForBuilds(builds *BuildQueue) {
+	worker := builds.addWorker()
 	for {
-		select {
-		case b, _ := <-builds.BuildCh:
-			if err := b.Job.Execute(b.Source); err != nil {
-				log.Printf("[E][app] Build failed: %v", err)
+		builds.beat(worker)
+		b := builds.next()
+		if b == nil {
+			select {
+			case <-builds.notifyCh:
+				continue
+			case <-time.After(heartbeatInterval):
+				continue
+			case <-builds.doneCh:
+				return
 			}
-		case <-builds.doneCh:
-			return
+		}
+
+		b.Job.Heartbeat = func() { builds.beat(worker) }
+		err := b.Job.ExecuteContext(b.ctx, b.Source)
+		if err != nil {
+			buildLog(appLog, b).Errorf("Build %d failed: %v", b.ID, err)
+		}
+		builds.finish(b, err)
+		if err := saveBuildInfo(b.Job.Config, b, builds.Info(b)); err != nil {
+			buildLog(appLog, b).Errorf("Failed to save build info: %v", err)
+		}
+		if err := indexBuildLogs(b.Job.Config, b); err != nil {
+			buildLog(appLog, b).Errorf("Failed to index build logs: %v", err)
 		}
 	}
 }
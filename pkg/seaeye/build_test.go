@@ -0,0 +1,63 @@
+package seaeye
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildQueueShutdown(t *testing.T) {
+	q := NewBuildQueue(10)
+	s1 := &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "abc"}
+	s2 := &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "def"}
+	b1, _ := q.Enqueue(&Job{}, s1)
+	b2, _ := q.Enqueue(&Job{}, s2)
+	assert.Equal(t, b1, q.next())
+	go func() {
+		<-b1.ctx.Done()
+		q.finish(b1, b1.ctx.Err())
+	}()
+
+	interrupted := q.Shutdown(0)
+	assert.Equal(t, []*Build{b1, b2}, interrupted)
+	assert.Equal(t, "error", b1.State)
+	assert.Equal(t, "error", b2.State)
+	assert.Equal(t, 0, q.Len())
+
+	_, err := q.Enqueue(&Job{}, s1)
+	assert.Equal(t, ErrShuttingDown, err)
+
+	dir, err := ioutil.TempDir("", "seaeye-queue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.json")
+	assert.NoError(t, SaveSources(path, interrupted))
+	sources, err := LoadSources(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Source{s1, s2}, sources)
+	sources, err = LoadSources(path)
+	assert.NoError(t, err)
+	assert.Empty(t, sources)
+}
+
+func TestBuildQueueNextSameRev(t *testing.T) {
+	q := NewBuildQueue(10)
+	q.Limit = func(s *Source) int { return 2 }
+	s1 := &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "abc"}
+	s2 := &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "def"}
+	b1, _ := q.Enqueue(&Job{}, s1)
+	b2, _ := q.Enqueue(&Job{}, s1)
+	b3, _ := q.Enqueue(&Job{}, s2)
+
+	assert.Equal(t, b1, q.next())
+	assert.Equal(t, b3, q.next(), "a build of the same revision waits")
+	assert.Nil(t, q.next())
+
+	q.finish(b1, nil)
+	assert.Equal(t, b2, q.next())
+}
@@ -0,0 +1,169 @@
+package seaeye
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client talks to the HTTP API of a remote seaeye server.
+type Client struct {
+	// BaseURL holds the server's link scheme, authority, and port.
+	BaseURL string
+	// Token holds the server's API token.
+	Token      string
+	HTTPClient *http.Client
+}
+
+// Builds lists all recent builds, newest first.
+func (c *Client) Builds() ([]*BuildInfo, error) {
+	var infos []*BuildInfo
+	err := c.do("GET", "/api/builds", nil, &infos)
+	return infos, err
+}
+
+// Build returns a single build.
+func (c *Client) Build(id int) (*BuildInfo, error) {
+	var info BuildInfo
+	err := c.do("GET", fmt.Sprintf("/api/builds/%d", id), nil, &info)
+	return &info, err
+}
+
+// Trigger enqueues a build of a repository (owner/repo) at a ref.
+func (c *Client) Trigger(repo, ref string) (*BuildInfo, error) {
+	var info BuildInfo
+	err := c.do("POST", "/api/builds", &TriggerRequest{Repo: repo, Ref: ref}, &info)
+	return &info, err
+}
+
+// Cancel cancels a pending or running build.
+func (c *Client) Cancel(id int) (*BuildInfo, error) {
+	var info BuildInfo
+	err := c.do("POST", fmt.Sprintf("/api/builds/%d/cancel", id), nil, &info)
+	return &info, err
+}
+
+// Log writes a build's log to w. With follow set, it keeps writing until the
+// build finished.
+func (c *Client) Log(id int, follow bool, w io.Writer) error {
+	path := fmt.Sprintf("/api/builds/%d/log", id)
+	if follow {
+		path += "?follow=1"
+	}
+	resp, err := c.request("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// PublicKey returns the server's public key to encrypt manifest secrets with.
+func (c *Client) PublicKey() (*rsa.PublicKey, error) {
+	resp, err := c.request("GET", "/api/key", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return ParsePublicKeyPEM(b)
+}
+
+// Secrets lists the secrets of a scope, or of all scopes if scope is "*".
+func (c *Client) Secrets(scope string) ([]*SecretInfo, error) {
+	path := "/api/secrets"
+	if scope != "*" {
+		path += "?scope=" + url.QueryEscape(scope)
+	}
+	var infos []*SecretInfo
+	err := c.do("GET", path, nil, &infos)
+	return infos, err
+}
+
+// SetSecret adds or replaces a secret in a scope.
+func (c *Client) SetSecret(scope, name, value string) (*SecretInfo, error) {
+	var info SecretInfo
+	path := fmt.Sprintf("/api/secrets/%s?scope=%s", url.QueryEscape(name), url.QueryEscape(scope))
+	err := c.do("PUT", path, &SecretRequest{Value: value}, &info)
+	return &info, err
+}
+
+// DeleteSecret removes a secret from a scope.
+func (c *Client) DeleteSecret(scope, name string) error {
+	path := fmt.Sprintf("/api/secrets/%s?scope=%s", url.QueryEscape(name), url.QueryEscape(scope))
+	resp, err := c.request("DELETE", path, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *Client) do(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	resp, err := c.request(method, path, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse response: %v", err)
+	}
+	return nil
+}
+
+// request sends a request and returns the response if successful.
+func (c *Client) request(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.BaseURL, "/")+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
@@ -1,32 +1,66 @@
 package seaeye
 
 import (
-	"log"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 const (
 	defaultHostPort         = ":19515" // "SEAE"(YE)
 	defaultBaseURL          = "http://localhost:19515"
 	defaultHookbotEndpoint  = ""
+	defaultJanitorInterval  = "1h"
+	defaultLogCompress      = "true"
+	defaultLogKeepBuilds    = "0"
+	defaultLogLimitFail     = "false"
+	defaultLogLimitMB       = "0"
+	defaultLogMaxAge        = "0"
+	defaultLogMaxSizeMB     = "0"
+	defaultWorkspaceMaxAge  = "0"
 	dockerHostVolumeBaseDir = ""
 	defaultGithubToken      = ""
 	defaultLogBaseDir       = "logs"
+	defaultLogFormat        = LogFormatText
+	defaultLogLevel         = "info"
 	defaultFetchBaseDir     = "workspace"
 	defaultExecTimeout      = "1h"
+	defaultHeartbeatTimeout = "90m"
+	defaultMinFreeMB        = "1024"
 	defaultNoNotify         = "false"
+	defaultAPIToken         = ""
+	defaultSecretKeyPath    = "seaeye.key"
+	defaultSecretStorePath  = "secrets.enc"
+	defaultSecretStoreKey   = ""
+	defaultAllowlist        = ""
+	defaultConcurrency      = "1"
+	defaultQueueCapacity    = "50"
+	defaultQueueFile        = "queue.json"
+	defaultShutdownTimeout  = "5m"
 
 	internalEnvPrefix = "SEAEYE_"
 )
 
 // Config specifies the configuration to run the seaeye application.
 type Config struct {
+	// Allowlist holds the patterns (see path.Match) of repositories
+	// (owner/repo) to build. If empty, all repositories are built.
+	Allowlist []string
+	// APIToken holds the bearer token required by the HTTP API. If empty, the
+	// API is read-only.
+	APIToken string
 	// BaseURL holds Seaeye's link scheme, authority, and port.
 	BaseURL string
+	// Concurrency holds the maximum number of builds running at once.
+	Concurrency int
 	// DockerHostVolumeBaseDir holds the host's Docker volume path prefix. If
 	// empty, it is assumed that either no volume was mounted on the host or
 	// that the volume mount paths on the host and in the container are
@@ -40,34 +74,272 @@ type Config struct {
 	// GithubToken holds a Personal Access Token for Github to authenticate
 	// commit status updates via Github API.
 	GithubToken string
+	// HeartbeatTimeout holds the time after which a build worker without
+	// progress is considered wedged. It should exceed ExecTimeout.
+	HeartbeatTimeout time.Duration
 	// HookbotEndpoint holds a hookbot subscription URL.
 	HookbotEndpoint string
 	// HostPort holds Seaeye's server host and port.
 	HostPort string
+	// JanitorInterval holds how often the janitor enforces the retention of
+	// logs and workspaces. 0 disables the janitor.
+	JanitorInterval time.Duration
 	// LogBaseDir holds the base directory to log files.
 	LogBaseDir string
+	// LogCompress decides if the janitor compresses the logs of finished
+	// builds.
+	LogCompress bool
+	// LogFormat holds the format of the server log: text, json, or logfmt.
+	LogFormat string
+	// LogKeepBuilds holds the number of builds per branch whose logs are
+	// kept. 0 keeps all.
+	LogKeepBuilds int
+	// LogLevel holds the minimum level of server log records.
+	LogLevel LogLevel
+	// LogLimitFail decides if a build exceeding LogLimitMB fails.
+	LogLimitFail bool
+	// LogLimitMB holds the size in megabytes of a build's log above which
+	// further output is discarded, keeping its head and tail. 0 disables the
+	// limit.
+	LogLimitMB int
+	// LogMaxAge holds the age after which build logs are removed. 0 keeps
+	// them.
+	LogMaxAge time.Duration
+	// LogMaxSizeMB holds the size in megabytes of all build logs above which
+	// the oldest get removed. 0 disables the limit.
+	LogMaxSizeMB int
+	// MinFreeMB holds the free space in megabytes the fetch and log
+	// directories need to have for the server to be ready. 0 disables the
+	// check.
+	MinFreeMB int
 	// NoNotify decides if webhook notifications are sent.
 	NoNotify bool
+	// QueueCapacity holds the maximum number of pending builds.
+	QueueCapacity int
+	// QueueFile holds the path of the file the builds interrupted by shutdown
+	// are saved to, to be requeued on the next start.
+	QueueFile string
+	// Repositories holds repository-specific settings by repository pattern,
+	// see Repo.
+	Repositories map[string]*RepoConfig
+	// SecretKeyPath holds the path to the private key decrypting manifest
+	// secrets. It gets generated if it doesn't exist.
+	SecretKeyPath string
+	// SecretStoreKey holds the base64 encoded 256 bit key encrypting the
+	// secret store. If empty, the secret store is disabled.
+	SecretStoreKey string
+	// SecretStorePath holds the path to the secret store file.
+	SecretStorePath string
+	// ShutdownTimeout holds how long shutting down waits for running builds
+	// before canceling them.
+	ShutdownTimeout time.Duration
 	// Seaeye version
 	Version string
+	// WorkspaceMaxAge holds the time after which the workspace of a repository
+	// not built since gets removed. 0 keeps workspaces.
+	WorkspaceMaxAge time.Duration
+}
+
+// configKeys lists the settings of a configuration file, each of which can be
+// overridden by the environment variable SEAEYE_<KEY>, with lists separated by
+// commas.
+var configKeys = []string{
+	"allowlist",
+	"api_token",
+	"baseurl",
+	"concurrency",
+	"docker_vol_basedir",
+	"exec_timeout",
+	"fetch_basedir",
+	"github_token",
+	"heartbeat_timeout",
+	"hookbot_endpoint",
+	"hostport",
+	"janitor_interval",
+	"log_basedir",
+	"log_compress",
+	"log_format",
+	"log_keep_builds",
+	"log_level",
+	"log_limit_fail",
+	"log_limit_mb",
+	"log_max_age",
+	"log_max_size_mb",
+	"min_free_mb",
+	"no_notify",
+	"queue_capacity",
+	"queue_file",
+	"repositories",
+	"secret_key",
+	"secret_store",
+	"secret_store_key",
+	"shutdown_timeout",
+	"workspace_max_age",
 }
 
-// NewConfig creates a new configuration with a mix of default values and
-// provided environment variables.
-func NewConfig() *Config {
-	log.Println("[I][config] Loading configuration")
+// restartConfigKeys lists the settings which only take effect on restart, as
+// they are bound to resources acquired at start or, as the log directory, to
+// previous builds.
+var restartConfigKeys = []string{"concurrency", "hostport", "log_basedir", "secret_key", "secret_store", "secret_store_key"}
+
+// secretConfigKeys lists the settings which can alternatively be read from the
+// file named by the environment variable SEAEYE_<KEY>_FILE.
+var secretConfigKeys = []string{"api_token", "github_token", "secret_store_key"}
+
+// NewConfig creates a new configuration with a mix of default values, the
+// values of the configuration file at path, if any, and provided environment
+// variables, in increasing order of precedence. All values are validated.
+func NewConfig(filePath string) (*Config, error) {
+	configLog.Infof("Loading configuration")
+
+	settings := map[string]string{
+		"allowlist":          defaultAllowlist,
+		"api_token":          defaultAPIToken,
+		"baseurl":            defaultBaseURL,
+		"concurrency":        defaultConcurrency,
+		"docker_vol_basedir": dockerHostVolumeBaseDir,
+		"exec_timeout":       defaultExecTimeout,
+		"fetch_basedir":      defaultFetchBaseDir,
+		"github_token":       defaultGithubToken,
+		"heartbeat_timeout":  defaultHeartbeatTimeout,
+		"hookbot_endpoint":   defaultHookbotEndpoint,
+		"hostport":           defaultHostPort,
+		"janitor_interval":   defaultJanitorInterval,
+		"log_basedir":        defaultLogBaseDir,
+		"log_compress":       defaultLogCompress,
+		"log_format":         defaultLogFormat,
+		"log_keep_builds":    defaultLogKeepBuilds,
+		"log_level":          defaultLogLevel,
+		"log_limit_fail":     defaultLogLimitFail,
+		"log_limit_mb":       defaultLogLimitMB,
+		"log_max_age":        defaultLogMaxAge,
+		"log_max_size_mb":    defaultLogMaxSizeMB,
+		"min_free_mb":        defaultMinFreeMB,
+		"no_notify":          defaultNoNotify,
+		"queue_capacity":     defaultQueueCapacity,
+		"queue_file":         defaultQueueFile,
+		"secret_key":         defaultSecretKeyPath,
+		"secret_store":       defaultSecretStorePath,
+		"secret_store_key":   defaultSecretStoreKey,
+		"shutdown_timeout":   defaultShutdownTimeout,
+		"workspace_max_age":  defaultWorkspaceMaxAge,
+	}
+
+	var errs configErrors
+	c := &Config{}
+
+	if filePath != "" {
+		configLog.Infof("Reading configuration file: %s", filePath)
+		b, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration: %v", err)
+		}
+		c.Repositories = parseConfigFile(b, settings, &errs)
+	}
+
+	for key := range settings {
+		if containsString(secretConfigKeys, key) {
+			v, err := getEnvOrFile(strings.ToUpper(key), settings[key])
+			if err != nil {
+				errs.add(key, "%v", err)
+			}
+			settings[key] = v
+		} else {
+			settings[key] = getEnvOr(strings.ToUpper(key), settings[key])
+		}
+	}
+
+	c.Allowlist = splitList(settings["allowlist"])
+	c.APIToken = settings["api_token"]
+	c.BaseURL = settings["baseurl"]
+	c.Concurrency = parsePositiveInt(settings, "concurrency", &errs)
+	c.DockerHostVolumeBaseDir = settings["docker_vol_basedir"]
+	c.ExecTimeout = parsePositiveDuration(settings, "exec_timeout", &errs)
+	c.FetchBaseDir = settings["fetch_basedir"]
+	c.GithubToken = settings["github_token"]
+	c.HeartbeatTimeout = parsePositiveDuration(settings, "heartbeat_timeout", &errs)
+	c.HookbotEndpoint = settings["hookbot_endpoint"]
+	c.HostPort = settings["hostport"]
+	c.JanitorInterval = parseDuration(settings, "janitor_interval", &errs)
+	c.LogBaseDir = settings["log_basedir"]
+	c.LogCompress = parseStrictBool(settings, "log_compress", &errs)
+	c.LogFormat = settings["log_format"]
+	c.LogKeepBuilds = parseInt(settings, "log_keep_builds", &errs)
+	c.LogLevel = parseLogLevel(settings, "log_level", &errs)
+	c.LogLimitFail = parseStrictBool(settings, "log_limit_fail", &errs)
+	c.LogLimitMB = parseInt(settings, "log_limit_mb", &errs)
+	c.LogMaxAge = parseDuration(settings, "log_max_age", &errs)
+	c.LogMaxSizeMB = parseInt(settings, "log_max_size_mb", &errs)
+	c.MinFreeMB = parseInt(settings, "min_free_mb", &errs)
+	c.NoNotify = parseStrictBool(settings, "no_notify", &errs)
+	c.QueueCapacity = parsePositiveInt(settings, "queue_capacity", &errs)
+	c.QueueFile = settings["queue_file"]
+	c.SecretKeyPath = settings["secret_key"]
+	c.SecretStoreKey = settings["secret_store_key"]
+	c.SecretStorePath = settings["secret_store"]
+	c.ShutdownTimeout = parseDuration(settings, "shutdown_timeout", &errs)
+	c.WorkspaceMaxAge = parseDuration(settings, "workspace_max_age", &errs)
+
+	if !containsString(logFormats, c.LogFormat) {
+		errs.add("log_format", "expected one of %s, got %q", strings.Join(logFormats, ", "), c.LogFormat)
+	}
+	for _, p := range c.Allowlist {
+		if _, err := path.Match(p, ""); err != nil {
+			errs.add("allowlist", "invalid pattern %q", p)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, errs
+	}
+	return c, nil
+}
+
+// parseConfigFile validates a configuration file, sets its scalar settings,
+// and returns its repository settings.
+func parseConfigFile(b []byte, settings map[string]string, errs *configErrors) map[string]*RepoConfig {
+	var raw yaml.MapSlice
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		errs.add("", "%v", err)
+		return nil
+	}
+
+	var repos map[string]*RepoConfig
+	for _, item := range raw {
+		key := fmt.Sprint(item.Key)
+		switch {
+		case !containsString(configKeys, key):
+			errs.unknownKey("", key, configKeys)
+		case key == "repositories":
+			repos = parseRepoConfigs(item.Value, errs)
+		case key == "allowlist":
+			var list []string
+			if err := remarshal(item.Value, &list); err != nil {
+				errs.add(key, "expected a list of patterns")
+			}
+			settings[key] = strings.Join(list, ",")
+		default:
+			switch v := item.Value.(type) {
+			case nil:
+				settings[key] = ""
+			case string, int, bool, float64:
+				settings[key] = fmt.Sprint(v)
+			default:
+				errs.add(key, "expected a single value")
+			}
+		}
+	}
+	return repos
+}
 
-	return &Config{
-		BaseURL:                 getEnvOr("BASEURL", defaultBaseURL),
-		DockerHostVolumeBaseDir: getEnvOr("DOCKER_VOL_BASEDIR", dockerHostVolumeBaseDir),
-		ExecTimeout:             mustParseDuration(getEnvOr("EXEC_TIMEOUT", defaultExecTimeout)),
-		FetchBaseDir:            getEnvOr("FETCH_BASEDIR", defaultFetchBaseDir),
-		GithubToken:             getEnvOr("GITHUB_TOKEN", defaultGithubToken),
-		HookbotEndpoint:         getEnvOr("HOOKBOT_ENDPOINT", defaultHookbotEndpoint),
-		HostPort:                getEnvOr("HOSTPORT", defaultHostPort),
-		LogBaseDir:              getEnvOr("LOG_BASEDIR", defaultLogBaseDir),
-		NoNotify:                parseBool(getEnvOr("NO_NOTIFY", defaultNoNotify)),
+// remarshal converts a generically unmarshaled YAML value to v.
+func remarshal(in, v interface{}) error {
+	b, err := yaml.Marshal(in)
+	if err != nil {
+		return err
 	}
+	return yaml.Unmarshal(b, v)
 }
 
 func getEnvOr(key, fallback string) string {
@@ -77,18 +349,213 @@ func getEnvOr(key, fallback string) string {
 	return fallback
 }
 
-func mustParseDuration(s string) time.Duration {
-	d, err := time.ParseDuration(s)
-	if err != nil {
-		log.Fatalf("[W][config] Failed to parse %s: %v", s, err)
+// getEnvOrFile returns the value of the environment variable SEAEYE_<KEY> or,
+// if not set, the content of the file named by SEAEYE_<KEY>_FILE, or fallback.
+func getEnvOrFile(key, fallback string) (string, error) {
+	if v := os.Getenv(internalEnvPrefix + key); v != "" {
+		return v, nil
+	}
+	if p := os.Getenv(internalEnvPrefix + key + "_FILE"); p != "" {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", p, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return fallback, nil
+}
+
+func parsePositiveInt(settings map[string]string, key string, errs *configErrors) int {
+	i, err := strconv.Atoi(settings[key])
+	if err != nil || i < 1 {
+		errs.add(key, "expected a positive number, got %q", settings[key])
+	}
+	return i
+}
+
+func parseInt(settings map[string]string, key string, errs *configErrors) int {
+	i, err := strconv.Atoi(settings[key])
+	if err != nil || i < 0 {
+		errs.add(key, "expected a number, got %q", settings[key])
+	}
+	return i
+}
+
+func parsePositiveDuration(settings map[string]string, key string, errs *configErrors) time.Duration {
+	d, err := time.ParseDuration(settings[key])
+	if err != nil || d <= 0 {
+		errs.add(key, "expected a positive duration, e.g. 1h30m, got %q", settings[key])
 	}
 	return d
 }
 
+func parseDuration(settings map[string]string, key string, errs *configErrors) time.Duration {
+	d, err := time.ParseDuration(settings[key])
+	if err != nil || d < 0 {
+		errs.add(key, "expected a duration, e.g. 1h30m, got %q", settings[key])
+	}
+	return d
+}
+
+func parseLogLevel(settings map[string]string, key string, errs *configErrors) LogLevel {
+	l, err := ParseLogLevel(settings[key])
+	if err != nil {
+		errs.add(key, "expected one of %s, got %q", strings.Join(logLevelNames, ", "), settings[key])
+	}
+	return l
+}
+
+func parseStrictBool(settings map[string]string, key string, errs *configErrors) bool {
+	switch strings.ToLower(settings[key]) {
+	case "1", "true", "yes":
+		return true
+	case "", "0", "false", "no":
+		return false
+	}
+	errs.add(key, "expected true or false, got %q", settings[key])
+	return false
+}
+
 func parseBool(s string) bool {
 	return s == "1" || strings.ToLower(s) == "true" || strings.ToLower(s) == "yes"
 }
 
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// configErrors collects all problems of a configuration.
+type configErrors []string
+
+func (e *configErrors) add(key, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if key != "" {
+		msg = key + ": " + msg
+	}
+	*e = append(*e, msg)
+}
+
+func (e *configErrors) unknownKey(path, key string, known []string) {
+	if path != "" {
+		path += "."
+	}
+	if k := closestKey(key, known); k != "" {
+		e.add(path+key, "unknown key, did you mean %q?", k)
+	} else {
+		e.add(path+key, "unknown key, expected one of: %s", strings.Join(known, ", "))
+	}
+}
+
+func (e configErrors) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+// configChange describes a setting changed between two configurations.
+type configChange struct {
+	Key string
+	Old string
+	New string
+}
+
+func (c configChange) String() string {
+	return fmt.Sprintf("%s: %q -> %q", c.Key, c.Old, c.New)
+}
+
+// diff returns the settings changed from c to next, sorted by key, with the
+// values of secret settings redacted.
+func (c *Config) diff(next *Config) []configChange {
+	old, new := c.settings(), next.settings()
+	keys := []string{}
+	for k := range old {
+		keys = append(keys, k)
+	}
+	for k := range new {
+		if _, ok := old[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []configChange
+	for _, k := range keys {
+		if old[k] == new[k] {
+			continue
+		}
+		change := configChange{Key: k, Old: old[k], New: new[k]}
+		if containsString(secretConfigKeys, k) {
+			change.Old, change.New = redact(change.Old), redact(change.New)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// settings returns the configuration in the form of a configuration file's
+// settings, with each repository section as a separate setting.
+func (c *Config) settings() map[string]string {
+	settings := map[string]string{
+		"allowlist":          strings.Join(c.Allowlist, ","),
+		"api_token":          c.APIToken,
+		"baseurl":            c.BaseURL,
+		"concurrency":        strconv.Itoa(c.Concurrency),
+		"docker_vol_basedir": c.DockerHostVolumeBaseDir,
+		"exec_timeout":       c.ExecTimeout.String(),
+		"fetch_basedir":      c.FetchBaseDir,
+		"github_token":       c.GithubToken,
+		"heartbeat_timeout":  c.HeartbeatTimeout.String(),
+		"hookbot_endpoint":   c.HookbotEndpoint,
+		"hostport":           c.HostPort,
+		"janitor_interval":   c.JanitorInterval.String(),
+		"log_basedir":        c.LogBaseDir,
+		"log_compress":       strconv.FormatBool(c.LogCompress),
+		"log_format":         c.LogFormat,
+		"log_keep_builds":    strconv.Itoa(c.LogKeepBuilds),
+		"log_level":          c.LogLevel.String(),
+		"log_limit_fail":     strconv.FormatBool(c.LogLimitFail),
+		"log_limit_mb":       strconv.Itoa(c.LogLimitMB),
+		"log_max_age":        c.LogMaxAge.String(),
+		"log_max_size_mb":    strconv.Itoa(c.LogMaxSizeMB),
+		"min_free_mb":        strconv.Itoa(c.MinFreeMB),
+		"no_notify":          strconv.FormatBool(c.NoNotify),
+		"queue_capacity":     strconv.Itoa(c.QueueCapacity),
+		"queue_file":         c.QueueFile,
+		"secret_key":         c.SecretKeyPath,
+		"secret_store":       c.SecretStorePath,
+		"secret_store_key":   c.SecretStoreKey,
+		"shutdown_timeout":   c.ShutdownTimeout.String(),
+		"workspace_max_age":  c.WorkspaceMaxAge.String(),
+	}
+	for pattern, r := range c.Repositories {
+		settings["repositories."+pattern] = fmt.Sprintf("%+v", *r)
+	}
+	return settings
+}
+
+// keepRestartSettings resets the settings listed in restartConfigKeys to the
+// values of old.
+func (c *Config) keepRestartSettings(old *Config) {
+	c.Concurrency = old.Concurrency
+	c.HostPort = old.HostPort
+	c.LogBaseDir = old.LogBaseDir
+	c.SecretKeyPath = old.SecretKeyPath
+	c.SecretStoreKey = old.SecretStoreKey
+	c.SecretStorePath = old.SecretStorePath
+}
+
+// redact hides a secret value, but not whether it is set.
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return string(secretMask)
+}
+
 // LogFilePath assembles a log file path from a job id and revision.
 func (c *Config) LogFilePath(jobID, rev string) (string, error) {
 	saneID := escapePath(jobID) // e.g.: scraperwiki/foo
@@ -97,6 +564,16 @@ func (c *Config) LogFilePath(jobID, rev string) (string, error) {
 	return filepath.Abs(filePath)
 }
 
+// CellLogFilePath assembles a log file path from a job id, revision, and matrix
+// cell name.
+func (c *Config) CellLogFilePath(jobID, rev, cell string) (string, error) {
+	saneID := escapePath(jobID)
+	saneRev := escapePath(rev)
+	saneCell := escapePath(cell) // e.g.: go-1.6/python-2.7
+	filePath := path.Join(c.LogBaseDir, saneID, saneRev, saneCell, "log.txt")
+	return filepath.Abs(filePath)
+}
+
 func escapePath(path string) string {
 	p := path
 	p = strings.Replace(p, "/", "_", -1)
@@ -0,0 +1,157 @@
+package seaeye
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// NotifierGithub names the notifier updating Github commit statuses.
+const NotifierGithub = "github"
+
+var (
+	repoConfigKeys = []string{"allowlist", "concurrency", "exec_timeout", "notifiers"}
+	notifierNames  = []string{NotifierGithub}
+)
+
+// RepoConfig specifies repository-specific settings.
+type RepoConfig struct {
+	// Allowlist holds the patterns (see path.Match) of branches to build. If
+	// empty, all branches are built. Tags and commits are always built.
+	Allowlist []string
+	// Concurrency holds the maximum number of builds of the repository running
+	// at once. Builds of the same revision always run one after the other.
+	Concurrency int
+	// ExecTimeout holds the timeout after which test execution steps are
+	// canceled.
+	ExecTimeout time.Duration
+	// Notifiers holds the names of the notifiers to report build results to.
+	Notifiers []string
+}
+
+// rawRepoConfig is the configuration file format of a RepoConfig.
+type rawRepoConfig struct {
+	Allowlist   []string  `yaml:"allowlist"`
+	Concurrency int       `yaml:"concurrency"`
+	ExecTimeout string    `yaml:"exec_timeout"`
+	Notifiers   *[]string `yaml:"notifiers"`
+}
+
+// parseRepoConfigs validates and converts the repositories section of a
+// configuration file. Sections are keyed by "owner/repo", "owner/*", or "*".
+func parseRepoConfigs(v interface{}, errs *configErrors) map[string]*RepoConfig {
+	sections, ok := v.(yaml.MapSlice)
+	if !ok {
+		if v != nil {
+			errs.add("repositories", "expected a mapping of repositories")
+		}
+		return nil
+	}
+
+	repos := map[string]*RepoConfig{}
+	for _, section := range sections {
+		pattern := fmt.Sprint(section.Key)
+		key := "repositories." + pattern
+		parts := strings.Split(pattern, "/")
+		if pattern != "*" && (len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "") {
+			errs.add(key, "expected owner/repo, owner/*, or *")
+			continue
+		}
+
+		if items, ok := section.Value.(yaml.MapSlice); ok {
+			for _, item := range items {
+				if k := fmt.Sprint(item.Key); !containsString(repoConfigKeys, k) {
+					errs.unknownKey(key, k, repoConfigKeys)
+				}
+			}
+		}
+		var raw rawRepoConfig
+		if err := remarshal(section.Value, &raw); err != nil {
+			errs.add(key, "%v", err)
+			continue
+		}
+
+		r := &RepoConfig{Allowlist: raw.Allowlist, Concurrency: raw.Concurrency}
+		if raw.Concurrency < 0 {
+			errs.add(key+".concurrency", "expected a positive number, got %d", raw.Concurrency)
+		}
+		if raw.ExecTimeout != "" {
+			d, err := time.ParseDuration(raw.ExecTimeout)
+			if err != nil || d <= 0 {
+				errs.add(key+".exec_timeout", "expected a positive duration, e.g. 1h30m, got %q", raw.ExecTimeout)
+			}
+			r.ExecTimeout = d
+		}
+		if raw.Notifiers != nil {
+			r.Notifiers = append([]string{}, *raw.Notifiers...)
+			for _, n := range r.Notifiers {
+				if !containsString(notifierNames, n) {
+					errs.add(key+".notifiers", "unknown notifier %q, expected one of: %s", n, strings.Join(notifierNames, ", "))
+				}
+			}
+		}
+		for _, p := range r.Allowlist {
+			if _, err := path.Match(p, ""); err != nil {
+				errs.add(key+".allowlist", "invalid pattern %q", p)
+			}
+		}
+		repos[pattern] = r
+	}
+	return repos
+}
+
+// Repo returns the settings of a repository. Settings of the "*" section are
+// overridden by the "owner/*" section's, which are overridden by the
+// "owner/repo" section's.
+func (c *Config) Repo(owner, repo string) *RepoConfig {
+	r := &RepoConfig{
+		Concurrency: 1,
+		ExecTimeout: c.ExecTimeout,
+		Notifiers:   []string{NotifierGithub},
+	}
+	for _, pattern := range []string{"*", owner + "/*", owner + "/" + repo} {
+		s, ok := c.Repositories[pattern]
+		if !ok {
+			continue
+		}
+		if s.Allowlist != nil {
+			r.Allowlist = s.Allowlist
+		}
+		if s.Concurrency > 0 {
+			r.Concurrency = s.Concurrency
+		}
+		if s.ExecTimeout > 0 {
+			r.ExecTimeout = s.ExecTimeout
+		}
+		if s.Notifiers != nil {
+			r.Notifiers = s.Notifiers
+		}
+	}
+	return r
+}
+
+// Allowed decides if a source is to be built given the repository and branch
+// allowlists.
+func (c *Config) Allowed(s *Source) bool {
+	if !matchAny(c.Allowlist, s.Owner+"/"+s.Repo) {
+		return false
+	}
+	branch := branchName(s.Ref)
+	return branch == "" || matchAny(c.Repo(s.Owner, s.Repo).Allowlist, branch)
+}
+
+// matchAny decides if name matches any of patterns, or if there are none.
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
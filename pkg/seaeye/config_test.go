@@ -0,0 +1,110 @@
+package seaeye
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "seaeye-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestNewConfig(t *testing.T) {
+	path := writeTempConfig(t, `hostport: ":8080"
+exec_timeout: 30m
+concurrency: 4
+allowlist: ["scraperwiki/*"]
+repositories:
+  "*":
+    notifiers: []
+  scraperwiki/*:
+    exec_timeout: 2h
+  scraperwiki/seaeye:
+    concurrency: 2
+    allowlist: [master, "release/*"]
+    notifiers: [github]
+`)
+	defer os.Remove(path)
+	os.Setenv("SEAEYE_HOSTPORT", ":9090")
+	defer os.Unsetenv("SEAEYE_HOSTPORT")
+
+	c, err := NewConfig(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ":9090", c.HostPort)
+	assert.Equal(t, 30*time.Minute, c.ExecTimeout)
+	assert.Equal(t, 4, c.Concurrency)
+	assert.Equal(t, 50, c.QueueCapacity)
+
+	r := c.Repo("scraperwiki", "seaeye")
+	assert.Equal(t, 2, r.Concurrency)
+	assert.Equal(t, 2*time.Hour, r.ExecTimeout)
+	assert.Equal(t, []string{"github"}, r.Notifiers)
+	r = c.Repo("scraperwiki", "hookbot")
+	assert.Equal(t, 1, r.Concurrency)
+	assert.Equal(t, []string{}, r.Notifiers)
+	assert.Equal(t, 30*time.Minute, c.Repo("someone", "else").ExecTimeout)
+
+	assert.True(t, c.Allowed(&Source{Owner: "scraperwiki", Repo: "seaeye", Ref: "refs/heads/release/1.0"}))
+	assert.True(t, c.Allowed(&Source{Owner: "scraperwiki", Repo: "seaeye", Ref: "refs/tags/v1.0"}))
+	assert.False(t, c.Allowed(&Source{Owner: "scraperwiki", Repo: "seaeye", Ref: "refs/heads/feature"}))
+	assert.True(t, c.Allowed(&Source{Owner: "scraperwiki", Repo: "hookbot", Ref: "refs/heads/feature"}))
+	assert.False(t, c.Allowed(&Source{Owner: "someone", Repo: "else", Ref: "refs/heads/master"}))
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	path := writeTempConfig(t, `exec_timout: 1h
+exec_timeout: soon
+concurrency: 0
+no_notify: maybe
+repositories:
+  seaeye:
+    concurrency: 1
+  scraperwiki/seaeye:
+    notifiers: [slack]
+    timeout: 1h
+`)
+	defer os.Remove(path)
+
+	_, err := NewConfig(path)
+	if assert.IsType(t, configErrors{}, err) {
+		assert.Equal(t, configErrors{
+			`concurrency: expected a positive number, got "0"`,
+			`exec_timeout: expected a positive duration, e.g. 1h30m, got "soon"`,
+			`exec_timout: unknown key, did you mean "exec_timeout"?`,
+			`no_notify: expected true or false, got "maybe"`,
+			`repositories.scraperwiki/seaeye.notifiers: unknown notifier "slack", expected one of: github`,
+			`repositories.scraperwiki/seaeye.timeout: unknown key, expected one of: allowlist, concurrency, exec_timeout, notifiers`,
+			`repositories.seaeye: expected owner/repo, owner/*, or *`,
+		}, err)
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	old := &Config{ExecTimeout: time.Hour, GithubToken: "old", QueueCapacity: 50}
+	new := &Config{
+		ExecTimeout:   time.Hour,
+		GithubToken:   "new",
+		QueueCapacity: 10,
+		Repositories:  map[string]*RepoConfig{"*": {Concurrency: 2}},
+	}
+	assert.Equal(t, []configChange{
+		{Key: "github_token", Old: "***", New: "***"},
+		{Key: "queue_capacity", Old: "50", New: "10"},
+		{Key: "repositories.*", Old: "", New: "{Allowlist:[] Concurrency:2 ExecTimeout:0s Notifiers:[]}"},
+	}, old.diff(new))
+	assert.Empty(t, new.diff(new))
+}
@@ -3,7 +3,9 @@ package seaeye
 import (
 	"fmt"
 	"io"
-	"log"
+	"os/exec"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/scraperwiki/git-prep-directory"
@@ -19,16 +21,17 @@ type GithubFetcher struct {
 
 // Fetch clones a Github repositry and checks out a given revision.
 func (g *GithubFetcher) Fetch() error {
-	log.Printf("[I][fetcher_github] Running git-prep-directory: %s %s %s",
+	l := fetcherLog.With(sourceFields(g.Source)...)
+	l.Infof("Running git-prep-directory: %s %s %s",
 		g.BaseDir, g.Source.URL, g.Source.Rev)
 	buildDir, err := git.PrepBuildDirectory(g.BaseDir, g.Source.URL, g.Source.Rev, 10*time.Minute, g.LogWriter)
 	if err != nil {
-		log.Printf("[E][fetcher_github] Fetch failed: %v", err)
+		l.Errorf("Fetch failed: %v", err)
 		return fmt.Errorf("fetch for %s %s failed: %v", g.Source.URL, g.Source.Rev, err)
 	}
 
 	g.buildDir = buildDir
-	log.Printf("[I][fetcher_github] Fetch succeeded: %s", g.buildDir.Dir)
+	l.Infof("Fetch succeeded: %s", g.buildDir.Dir)
 	return nil
 }
 
@@ -38,9 +41,10 @@ func (g *GithubFetcher) Cleanup() {
 		return
 	}
 
-	log.Printf("[I][fetcher_github] Starting cleanup")
+	l := fetcherLog.With(sourceFields(g.Source)...)
+	l.Infof("Starting cleanup")
 	g.buildDir.Cleanup()
-	log.Printf("[I][fetcher_github] Cleanup finished")
+	l.Infof("Cleanup finished")
 }
 
 // CheckoutDir returns the directory of the checked out files.
@@ -50,3 +54,59 @@ func (g *GithubFetcher) CheckoutDir() string {
 	}
 	return g.buildDir.Dir
 }
+
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// ResolveRef resolves a branch, tag, or other ref of a remote repository to a
+// commit and the full name of the ref. Commits are returned as they are,
+// without ref name.
+func ResolveRef(url, ref string) (rev, name string, err error) {
+	if commitPattern.MatchString(ref) {
+		return ref, "", nil
+	}
+
+	out, err := exec.Command("git", "ls-remote", url, ref).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve %s %s: %v", url, ref, err)
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	rev, name, err = matchRef(refs, ref)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve %s %s: %v", url, ref, err)
+	}
+	return rev, name, nil
+}
+
+// matchRef looks up ref by its full name, then as branch, then as tag, in a
+// mapping of ref names to commits as listed by git ls-remote. Annotated tags
+// resolve to the commit they point to. A branch and a tag of the same name
+// pointing to different commits are ambiguous.
+func matchRef(refs map[string]string, ref string) (rev, name string, err error) {
+	peeled := func(name string) string {
+		if rev, ok := refs[name+"^{}"]; ok {
+			return rev
+		}
+		return refs[name]
+	}
+	if _, ok := refs[ref]; ok {
+		return peeled(ref), ref, nil
+	}
+
+	branch, tag := "refs/heads/"+ref, "refs/tags/"+ref
+	_, isBranch := refs[branch]
+	_, isTag := refs[tag]
+	switch {
+	case isBranch && isTag && peeled(branch) != peeled(tag):
+		return "", "", fmt.Errorf("ambiguous ref, use %s or %s", branch, tag)
+	case isBranch:
+		return peeled(branch), branch, nil
+	case isTag:
+		return peeled(tag), tag, nil
+	}
+	return "", "", fmt.Errorf("no such ref")
+}
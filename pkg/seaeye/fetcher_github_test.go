@@ -0,0 +1,33 @@
+package seaeye
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchRef(t *testing.T) {
+	refs := map[string]string{
+		"refs/heads/foo/master": "a1",
+		"refs/heads/master":     "a2",
+		"refs/remotes/master":   "a3",
+		"refs/tags/v1":          "a4",
+		"refs/tags/v1^{}":       "a5",
+		"refs/heads/v2":         "a6",
+		"refs/tags/v2":          "a7",
+	}
+	for ref, want := range map[string][2]string{
+		"master":            {"a2", "refs/heads/master"},
+		"refs/heads/master": {"a2", "refs/heads/master"},
+		"v1":                {"a5", "refs/tags/v1"},
+	} {
+		rev, name, err := matchRef(refs, ref)
+		assert.NoError(t, err)
+		assert.Equal(t, want, [2]string{rev, name}, ref)
+	}
+
+	_, _, err := matchRef(refs, "v2")
+	assert.EqualError(t, err, "ambiguous ref, use refs/heads/v2 or refs/tags/v2")
+	_, _, err = matchRef(refs, "foo")
+	assert.EqualError(t, err, "no such ref")
+}
@@ -0,0 +1,19 @@
+package seaeye
+
+// LocalFetcher uses an existing local checkout instead of fetching one.
+type LocalFetcher struct {
+	Dir string
+}
+
+// Fetch does nothing as the checkout already exists.
+func (l *LocalFetcher) Fetch() error {
+	return nil
+}
+
+// Cleanup does nothing as the checkout is not owned by the fetcher.
+func (l *LocalFetcher) Cleanup() {}
+
+// CheckoutDir returns the directory of the local checkout.
+func (l *LocalFetcher) CheckoutDir() string {
+	return l.Dir
+}
@@ -10,9 +10,12 @@ import (
 	"golang.org/x/oauth2"
 )
 
-// Source represents a specific snapshot of a Github remote repository.
+// Source represents a specific snapshot of a Github remote repository, and the
+// ref and user that pushed it, if known.
 type Source struct {
 	Owner, Repo, Rev, URL string
+	Ref, Pusher           string
+	Fork                  bool
 }
 
 // OAuthGithubClient is a thin wrapper around the google/go-github client with
@@ -29,6 +32,18 @@ func NewOAuthGithubClient(token string) *OAuthGithubClient {
 	return &OAuthGithubClient{Client: github.NewClient(tc)}
 }
 
+// CheckCredentials verifies that the client's token is accepted by Github.
+func (c *OAuthGithubClient) CheckCredentials() error {
+	limits, _, err := c.RateLimits()
+	if err != nil {
+		return fmt.Errorf("invalid Github credentials: %v", err)
+	}
+	if limits != nil && limits.Core != nil {
+		metricGithubRateLimitRemaining.Set(float64(limits.Core.Remaining))
+	}
+	return nil
+}
+
 // PushEventFromRequest parses the body of a POST request and returns a
 // (minimal) Github API v3 push event.
 func PushEventFromRequest(req *http.Request) (*github.PushEvent, error) {
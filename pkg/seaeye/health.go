@@ -0,0 +1,101 @@
+package seaeye
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// credentialsCheckInterval defines how long the result of checking the Github
+// credentials is reused, to spare the rate limit.
+const credentialsCheckInterval = 5 * time.Minute
+
+// HealthCheck describes the result of a single readiness check.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Readiness describes if the server is ready to run builds.
+type Readiness struct {
+	Ready  bool           `json:"ready"`
+	Checks []*HealthCheck `json:"checks"`
+}
+
+func (r *Readiness) add(name string, err error) {
+	c := &HealthCheck{Name: name, OK: err == nil}
+	if err != nil {
+		c.Message = err.Error()
+		r.Ready = false
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// checkDir checks that a directory is writable and has at least minFreeMB
+// megabytes of free space.
+func checkDir(dir string, minFreeMB int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".seaeye-readyz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return err
+	}
+
+	if minFreeMB == 0 {
+		return nil
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	if free := st.Bavail * uint64(st.Bsize) >> 20; free < uint64(minFreeMB) {
+		return fmt.Errorf("%s: %d MB free, need %d MB", dir, free, minFreeMB)
+	}
+	return nil
+}
+
+// checkWorkers checks that all build workers reported progress within
+// timeout.
+func checkWorkers(q *BuildQueue, timeout time.Duration) error {
+	if q.Closed() {
+		return ErrShuttingDown
+	}
+	heartbeats := q.Heartbeats()
+	if len(heartbeats) == 0 {
+		return fmt.Errorf("no workers")
+	}
+	for i, t := range heartbeats {
+		if d := time.Since(t); d > timeout {
+			return fmt.Errorf("worker %d: no heartbeat for %v", i+1, d-d%time.Second)
+		}
+	}
+	return nil
+}
+
+// credentialsCheck checks Github credentials, caching the result.
+type credentialsCheck struct {
+	mu      sync.Mutex
+	token   string
+	checked time.Time
+	err     error
+}
+
+func (c *credentialsCheck) check(token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if token == c.token && time.Since(c.checked) < credentialsCheckInterval {
+		return c.err
+	}
+	c.token, c.checked = token, time.Now()
+	c.err = NewOAuthGithubClient(token).CheckCredentials()
+	return c.err
+}
@@ -0,0 +1,23 @@
+package seaeye
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckWorkers(t *testing.T) {
+	q := NewBuildQueue(1)
+	assert.EqualError(t, checkWorkers(q, time.Minute), "no workers")
+
+	w := q.addWorker()
+	assert.NoError(t, checkWorkers(q, time.Minute))
+	q.heartbeats[w] = time.Now().Add(-2 * time.Minute)
+	assert.EqualError(t, checkWorkers(q, time.Minute), "worker 1: no heartbeat for 2m0s")
+	q.beat(w)
+	assert.NoError(t, checkWorkers(q, time.Minute))
+
+	q.Shutdown(0)
+	assert.Equal(t, ErrShuttingDown, checkWorkers(q, time.Minute))
+}
@@ -0,0 +1,410 @@
+package seaeye
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// buildInfoFile names the file in a build's log directory describing the
+// build, see BuildInfo.
+const buildInfoFile = "build.json"
+
+// janitorRetryInterval defines how often a disabled janitor checks whether it
+// got enabled by a reload.
+const janitorRetryInterval = time.Minute
+
+// Janitor periodically enforces the retention of build logs and workspaces,
+// and compresses the logs of finished builds.
+type Janitor struct {
+	Builds *BuildQueue
+	Config func() *Config
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// logDir describes the log directory of a build, holding the logs of all of
+// its matrix cells.
+type logDir struct {
+	path string
+	info *BuildInfo // nil for logs written before build records
+	repo string     // escaped owner/repo
+	size int64      // set for finished builds only
+	time time.Time
+}
+
+// Start runs the janitor every JanitorInterval until stopped.
+func (j *Janitor) Start() {
+	j.stopCh = make(chan struct{})
+	j.doneCh = make(chan struct{})
+	go func() {
+		defer close(j.doneCh)
+		for {
+			interval := j.Config().JanitorInterval
+			if interval > 0 {
+				j.Run()
+			} else {
+				interval = janitorRetryInterval
+			}
+			select {
+			case <-time.After(interval):
+			case <-j.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the janitor, waiting for a running pass to finish.
+func (j *Janitor) Stop() {
+	if j.stopCh == nil {
+		return
+	}
+	close(j.stopCh)
+	<-j.doneCh
+}
+
+// Run removes the log directories of finished builds exceeding LogMaxAge,
+// LogKeepBuilds per branch, or, oldest first, LogMaxSizeMB in total, then
+// compresses the remaining logs, and removes the workspaces of repositories not
+// built within WorkspaceMaxAge. Queued and running builds are left alone, also
+// when queued during the pass.
+func (j *Janitor) Run() {
+	c := j.Config()
+	active := map[string]bool{} // log directories and workspaces
+	for _, b := range j.Builds.List() {
+		if b.State != BuildQueued && b.State != BuildRunning {
+			continue
+		}
+		if p, err := c.LogFilePath(escapePath(path.Join(b.Owner, b.Repo)), b.Rev); err == nil {
+			active[filepath.Dir(p)] = true
+		}
+		active[filepath.Join(c.FetchBaseDir, b.Owner, b.Repo)] = true
+	}
+
+	dirs, err := scanLogDirs(c.LogBaseDir)
+	if err != nil {
+		appLog.Errorf("Janitor failed to scan logs: %v", err)
+		return
+	}
+	lastBuilt := map[string]time.Time{} // by escaped owner/repo
+	var finished []*logDir
+	for _, d := range dirs {
+		if d.time.After(lastBuilt[d.repo]) {
+			lastBuilt[d.repo] = d.time
+		}
+		if !active[d.path] {
+			d.size = dirSize(d.path)
+			finished = append(finished, d)
+		}
+	}
+
+	kept := j.removeLogDirs(c, finished)
+	if c.LogCompress {
+		for _, d := range kept {
+			var err error
+			j.idle(c, d.path, func() { err = compressLogDir(d.path) })
+			if err != nil {
+				appLog.Errorf("Janitor failed to compress logs %s: %v", d.path, err)
+			}
+		}
+	}
+	if c.WorkspaceMaxAge > 0 {
+		j.removeWorkspaces(c, active, lastBuilt)
+	}
+}
+
+// removeLogDirs removes the log directories exceeding the retention policies,
+// and returns the ones kept, newest first.
+func (j *Janitor) removeLogDirs(c *Config, dirs []*logDir) []*logDir {
+	sort.Sort(byTimeDesc(dirs))
+
+	now := time.Now()
+	perBranch := map[string]int{}
+	var total int64
+	var kept []*logDir
+	for _, d := range dirs {
+		branch := d.repo
+		if d.info != nil {
+			branch += " " + d.info.Ref
+		}
+		perBranch[branch]++
+
+		var reason string
+		switch {
+		case c.LogMaxAge > 0 && now.Sub(d.time) > c.LogMaxAge:
+			reason = "older than " + c.LogMaxAge.String()
+		case c.LogKeepBuilds > 0 && perBranch[branch] > c.LogKeepBuilds:
+			reason = "beyond the builds to keep per branch"
+		case c.LogMaxSizeMB > 0 && total+d.size > int64(c.LogMaxSizeMB)<<20:
+			reason = "beyond the maximum size"
+		}
+		if reason == "" {
+			total += d.size
+			kept = append(kept, d)
+			continue
+		}
+
+		var err error
+		if !j.idle(c, d.path, func() {
+			appLog.Infof("Janitor removing logs %s: %s", d.path, reason)
+			err = os.RemoveAll(d.path)
+		}) {
+			continue
+		}
+		if err != nil {
+			appLog.Errorf("Janitor failed to remove logs %s: %v", d.path, err)
+			continue
+		}
+		metricJanitorRemoved.Inc("logs")
+		metricJanitorRemovedBytes.Add(float64(d.size), "logs")
+	}
+	return kept
+}
+
+// removeWorkspaces removes the workspaces of repositories not built within
+// WorkspaceMaxAge, as per their logs or else their modification time.
+func (j *Janitor) removeWorkspaces(c *Config, active map[string]bool, lastBuilt map[string]time.Time) {
+	owners, err := ioutil.ReadDir(c.FetchBaseDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			appLog.Errorf("Janitor failed to scan workspaces: %v", err)
+		}
+		return
+	}
+	for _, owner := range owners {
+		if !owner.IsDir() {
+			continue
+		}
+		repos, err := ioutil.ReadDir(filepath.Join(c.FetchBaseDir, owner.Name()))
+		if err != nil {
+			appLog.Errorf("Janitor failed to scan workspaces: %v", err)
+			continue
+		}
+		for _, repo := range repos {
+			p := filepath.Join(c.FetchBaseDir, owner.Name(), repo.Name())
+			built, ok := lastBuilt[escapePath(path.Join(owner.Name(), repo.Name()))]
+			if !ok {
+				built = repo.ModTime()
+			}
+			if !repo.IsDir() || active[p] || time.Since(built) <= c.WorkspaceMaxAge {
+				continue
+			}
+
+			size := dirSize(p)
+			var err error
+			if !j.idle(c, p, func() {
+				appLog.Infof("Janitor removing workspace %s: not built for %v", p, c.WorkspaceMaxAge)
+				err = os.RemoveAll(p)
+			}) {
+				continue
+			}
+			if err != nil {
+				appLog.Errorf("Janitor failed to remove workspace %s: %v", p, err)
+				continue
+			}
+			metricJanitorRemoved.Inc("workspaces")
+			metricJanitorRemovedBytes.Add(float64(size), "workspaces")
+		}
+	}
+}
+
+// idle runs f unless a queued or running build uses dir as log directory or
+// workspace, re-checked right before under the build queue's lock, so no
+// build starts in the meantime. It reports whether f ran.
+func (j *Janitor) idle(c *Config, dir string, f func()) bool {
+	return j.Builds.unlessActive(func(b *Build) bool {
+		if filepath.Join(c.FetchBaseDir, b.Source.Owner, b.Source.Repo) == dir {
+			return true
+		}
+		p, err := b.LogFilePath(c)
+		return err == nil && filepath.Dir(p) == dir
+	}, f)
+}
+
+// scanLogDirs returns the build log directories under base, i.e.
+// base/{owner_repo}/{rev}.
+func scanLogDirs(base string) ([]*logDir, error) {
+	repos, err := ioutil.ReadDir(base)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var dirs []*logDir
+	for _, repo := range repos {
+		if !repo.IsDir() {
+			continue
+		}
+		revs, err := ioutil.ReadDir(filepath.Join(base, repo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, rev := range revs {
+			if !rev.IsDir() {
+				continue
+			}
+			d := &logDir{
+				path: filepath.Join(base, repo.Name(), rev.Name()),
+				repo: repo.Name(),
+				time: rev.ModTime(),
+			}
+			if info, err := readBuildInfo(d.path); err == nil {
+				d.info = info
+				if info.Finished != nil {
+					d.time = *info.Finished
+				}
+			}
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs, nil
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+type byTimeDesc []*logDir
+
+func (d byTimeDesc) Len() int           { return len(d) }
+func (d byTimeDesc) Less(i, j int) bool { return d[i].time.After(d[j].time) }
+func (d byTimeDesc) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// saveBuildInfo writes the description of a finished build to its log
+// directory.
+func saveBuildInfo(c *Config, b *Build, info *BuildInfo) error {
+	p, err := b.LogFilePath(c)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(filepath.Dir(p), buildInfoFile), data, 0644)
+}
+
+func readBuildInfo(dir string) (*BuildInfo, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, buildInfoFile))
+	if err != nil {
+		return nil, err
+	}
+	var info BuildInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// savedBuild returns the newest build recorded with id in the log directories,
+// for builds no longer among the recent ones.
+func savedBuild(c *Config, id int) (*Build, error) {
+	dirs, err := scanLogDirs(c.LogBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	var found *BuildInfo
+	for _, d := range dirs {
+		if d.info != nil && d.info.ID == id && (found == nil || d.info.Created.After(found.Created)) {
+			found = d.info
+		}
+	}
+	if found == nil {
+		return nil, ErrBuildNotFound
+	}
+	return &Build{
+		ID:      found.ID,
+		Source:  &Source{Owner: found.Owner, Repo: found.Repo, Rev: found.Rev, Ref: found.Ref},
+		State:   found.State,
+		Created: found.Created,
+	}, nil
+}
+
+// compressLogDir replaces the log and frames files in dir, including those of
+// matrix cells, by gzip compressed ones with the suffix ".gz".
+func compressLogDir(dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name := fi.Name(); fi.IsDir() || (name != "log.txt" && name != "frames.jsonl") {
+			return nil
+		}
+		return compressFile(p)
+	})
+}
+
+func compressFile(p string) error {
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(p + ".gz.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), p+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// openLogFile opens a log file or, if it got compressed, the compressed one,
+// reporting which.
+func openLogFile(p string) (f *os.File, compressed bool, err error) {
+	f, err = os.Open(p)
+	if os.IsNotExist(err) {
+		if gz, gzErr := os.Open(p + ".gz"); gzErr == nil {
+			return gz, true, nil
+		}
+	}
+	return f, false, err
+}
+
+// readLogFile reads a log file, decompressing it if it got compressed.
+func readLogFile(p string) ([]byte, error) {
+	f, compressed, err := openLogFile(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if !compressed {
+		return ioutil.ReadAll(f)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
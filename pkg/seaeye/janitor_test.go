@@ -0,0 +1,112 @@
+package seaeye
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJanitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seaeye-janitor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Config{
+		FetchBaseDir:    filepath.Join(dir, "workspace"),
+		LogBaseDir:      filepath.Join(dir, "logs"),
+		LogCompress:     true,
+		LogKeepBuilds:   1,
+		LogMaxAge:       24 * time.Hour,
+		WorkspaceMaxAge: 24 * time.Hour,
+	}
+	q := NewBuildQueue(10)
+	now := time.Now()
+	addLog := func(owner, rev, ref string, finished time.Time) string {
+		b := &Build{Source: &Source{Owner: owner, Repo: "seaeye", Rev: rev, Ref: ref}, Finished: finished}
+		p, err := b.LogFilePath(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, ioutil.WriteFile(p, []byte("log\n"), 0644))
+		assert.NoError(t, saveBuildInfo(c, b, b.info()))
+		return filepath.Dir(p)
+	}
+	master1 := addLog("scraperwiki", "a1", "refs/heads/master", now.Add(-2*time.Hour))
+	master2 := addLog("scraperwiki", "a2", "refs/heads/master", now.Add(-time.Hour))
+	feature := addLog("scraperwiki", "b1", "refs/heads/feature", now.Add(-3*time.Hour))
+	old := addLog("someone", "c1", "refs/heads/master", now.Add(-48*time.Hour))
+	assert.NoError(t, os.MkdirAll(filepath.Join(c.FetchBaseDir, "scraperwiki", "seaeye"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(c.FetchBaseDir, "someone", "seaeye"), 0755))
+
+	// A queued build's log is left alone.
+	q.Enqueue(&Job{}, &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "a1"})
+
+	j := &Janitor{Builds: q, Config: func() *Config { return c }}
+	j.Run()
+
+	assert.True(t, exists(master1))
+	assert.True(t, exists(filepath.Join(master1, "log.txt")))
+	assert.True(t, exists(filepath.Join(master2, "log.txt.gz")))
+	assert.False(t, exists(filepath.Join(master2, "log.txt")))
+	assert.True(t, exists(feature))
+	assert.False(t, exists(old))
+	assert.True(t, exists(filepath.Join(c.FetchBaseDir, "scraperwiki", "seaeye")))
+	assert.False(t, exists(filepath.Join(c.FetchBaseDir, "someone", "seaeye")))
+
+	b, err := readLogFile(filepath.Join(master2, "log.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "log\n", string(b))
+
+	// Once the queued build is gone, only the latest master build is kept.
+	q = NewBuildQueue(10)
+	j.Builds = q
+	j.Run()
+	assert.False(t, exists(master1))
+	assert.True(t, exists(master2))
+
+	// Builds queued during a pass are checked for right before removing.
+	q.Enqueue(&Job{}, &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "a2"})
+	assert.False(t, j.idle(c, master2, func() { t.Error("ran for a queued build's logs") }))
+	assert.False(t, j.idle(c, filepath.Join(c.FetchBaseDir, "scraperwiki", "seaeye"), func() { t.Error("ran for a queued build's workspace") }))
+	assert.True(t, j.idle(c, feature, func() {}))
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestSavedBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seaeye-saved-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Config{LogBaseDir: dir}
+	now := time.Now()
+	for i, rev := range []string{"a1", "a2", "a3"} {
+		id := 1 + i%2 // IDs restart with the server
+		b := &Build{ID: id, Source: &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: rev}, Created: now.Add(time.Duration(i) * time.Minute)}
+		p, err := b.LogFilePath(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, saveBuildInfo(c, b, b.info()))
+	}
+
+	b, err := savedBuild(c, 1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a3", b.Source.Rev)
+	}
+	_, err = savedBuild(c, 3)
+	assert.Equal(t, ErrBuildNotFound, err)
+}
@@ -1,43 +1,62 @@
 package seaeye
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/scraperwiki/seaeye/pkg/exec"
 	"golang.org/x/net/context"
 )
 
+// ErrLogLimitExceeded fails a build whose log exceeded LogLimitMB, if
+// LogLimitFail is set.
+var ErrLogLimitExceeded = errors.New("log limit exceeded")
+
 // Job is responsible for an describes all necessary modules to execute a job.
 type Job struct {
-	Config   *Config     // ...to prefix targetURL with BaseURL.
-	Fetcher  Fetcher     // ...to clone git repo.
-	ID       string      // ...to identify for logs.
-	Logger   *FileLogger // ...to accessed persistent and durable logs via REST endpoint.
-	Manifest *Manifest   // ...to make testing easier.
-	Notifier Notifier    // ...to update commmit statuses.
-}
-
-type step struct {
-	name         string
-	instructions [][]string
-	relevant     bool
+	BuildID     string       // ...to expose to commands.
+	Config      *Config      // ...to prefix targetURL with BaseURL.
+	Fetcher     Fetcher      // ...to clone git repo.
+	Heartbeat   func()       // ...to report progress, if set.
+	ID          string       // ...to identify for logs.
+	Logger      *FileLogger  // ...to accessed persistent and durable logs via REST endpoint.
+	Manifest    *Manifest    // ...to make testing easier.
+	Notifier    Notifier     // ...to update commmit statuses.
+	SecretKey   *SecretKey   // ...to decrypt manifest secrets.
+	SecretStore *SecretStore // ...to inject server-side secrets.
+	repo        *RepoConfig
+	result      string
+	source      *Source
 }
 
 // Execute executes a given task: 1. Setup, 2. Run (2a. Fetch, 2b. Test).
 func (j *Job) Execute(s *Source) error {
+	return j.ExecuteContext(context.Background(), s)
+}
+
+// ExecuteContext executes a given task like Execute does, canceling all
+// running commands once ctx is done.
+func (j *Job) ExecuteContext(ctx context.Context, s *Source) error {
 	if err := j.setup(s); err != nil {
 		return err
 	}
-	defer j.Logger.outFile.Close()
+	defer j.Logger.Close()
 
 	j.Logger.Printf("[I][job] %s Running", j.ID)
-	if err := j.run(); err != nil {
+	if err := j.run(ctx); err != nil {
 		j.Logger.Printf("[E][job] %s Run failed: %v", j.ID, err)
 		return err
 	}
@@ -47,6 +66,9 @@ func (j *Job) Execute(s *Source) error {
 
 // Setup ensures that all relevant job parts are configured and instatiated.
 func (j *Job) setup(s *Source) error {
+	j.source = s
+	j.repo = j.Config.Repo(s.Owner, s.Repo)
+
 	if j.ID == "" {
 		j.ID = escapePath(path.Join(s.Owner, s.Repo))
 	}
@@ -60,38 +82,75 @@ func (j *Job) setup(s *Source) error {
 		if err != nil {
 			return err
 		}
+		logger.Server = jobLog.With(sourceFields(s)...)
+		if id, err := strconv.Atoi(j.BuildID); err == nil {
+			logger.Server = logger.Server.With("build_id", id)
+		}
+		logger.SetLimit(int64(j.Config.LogLimitMB) << 20)
 		j.Logger = logger
 		j.Logger.Printf("[I][job] %s Created logger: %s", j.ID, j.Logger.outFile.Name())
 	}
+	j.Logger.Masker.Add(j.Config.GithubToken, j.Config.APIToken, j.Config.SecretStoreKey)
 
 	if j.Fetcher == nil {
 		f := &GithubFetcher{
 			BaseDir:   path.Join(j.Config.FetchBaseDir, s.Owner, s.Repo),
-			LogWriter: j.Logger.outFile,
+			LogWriter: j.Logger.Writer(),
 			Source:    s,
 		}
 		j.Fetcher = f
 	}
 
+	j.setupNotifier()
+	return nil
+}
+
+// setupNotifier configures the notifier, unless given.
+func (j *Job) setupNotifier() {
 	if j.Config.NoNotify {
 		j.Notifier = &DiscardNotifier{}
 	}
+	if j.Notifier == nil && !containsString(j.repo.Notifiers, NotifierGithub) {
+		j.Notifier = &DiscardNotifier{}
+	}
 	if j.Notifier == nil {
 		c := NewOAuthGithubClient(j.Config.GithubToken)
-		t := j.Config.BaseURL + fmt.Sprintf("/jobs/%s/status/%s", j.ID, escapePath(s.Rev))
 		n := &GithubNotifier{
 			Client:    c,
-			Source:    s,
-			TargetURL: t,
+			Source:    j.source,
+			TargetURL: j.targetURL(""),
 		}
 		j.Notifier = n
 	}
+}
 
-	return nil
+// Abort reports a build that won't finish, e.g. as it got interrupted or never
+// started, as errored.
+func (j *Job) Abort(s *Source, desc string) error {
+	if j.Notifier == nil {
+		j.source = s
+		j.repo = j.Config.Repo(s.Owner, s.Repo)
+		if j.ID == "" {
+			j.ID = escapePath(path.Join(s.Owner, s.Repo))
+		}
+		j.setupNotifier()
+	}
+	return j.Notifier.Notify("error", desc)
+}
+
+// targetURL returns the status page URL of the job or one of its matrix cells.
+func (j *Job) targetURL(cell string) string {
+	t := j.Config.BaseURL + fmt.Sprintf("/jobs/%s/status/%s", j.ID, escapePath(j.source.Rev))
+	if cell != "" {
+		t += "/" + escapePath(cell)
+	}
+	return t
 }
 
-// Run executes the pipeline.
-func (j *Job) run() error {
+// Run executes the pipeline. Once the manifest is known, every stage whose
+// needs are met runs (subject to each command's condition) and the Cleanup
+// stage is guaranteed to run, even when the build got canceled or timed out.
+func (j *Job) run(ctx context.Context) error {
 	//_ = j.Notifier.Notify("pending", "Starting...")
 
 	// TODO(uwe): Either fetch into a docker container already running, or
@@ -107,129 +166,593 @@ func (j *Job) run() error {
 	// - Should getting tools be specified in the manifest as docker run commands?
 
 	// Fetch
-	j.Logger.Printf("[I][job] %s Fetching started", j.ID)
+	logger := j.Logger.Stage("Fetch")
+	logger.Printf("[I][job] %s Fetching started", j.ID)
 	//_ = j.Notifier.Notify("pending", "Stage Fetching started")
-	if err := j.Fetcher.Fetch(); err != nil {
-		j.Logger.Printf("[E][job] %s Fetching failed: %v", j.ID, err)
+	repo := path.Join(j.source.Owner, j.source.Repo)
+	start := time.Now()
+	err := j.Fetcher.Fetch()
+	metricFetchDuration.Observe(time.Since(start).Seconds(), repo)
+	if err != nil {
+		metricFetchFailures.Inc(repo)
+		logger.Printf("[E][job] %s Fetching failed: %v", j.ID, err)
 		_ = j.Notifier.Notify("error", "Stage Fetching failed")
+		wd := j.Fetcher.CheckoutDir()
+		if wd != "" {
+			wd, _ = filepath.Abs(wd)
+		}
+		j.runAfterFailure(ctx, wd)
 		return err
 	}
-	j.Logger.Printf("[I][job] %s Fetching succeeded", j.ID)
+	logger.Printf("[I][job] %s Fetching succeeded", j.ID)
 
 	// Defer Cleanup
 	//defer j.Fetcher.Cleanup()
 
 	// Prepare
-	j.Logger.Printf("[I][job] %s Preparing started", j.ID)
+	logger = j.Logger.Stage("Prepare")
+	logger.Printf("[I][job] %s Preparing started", j.ID)
 	//_ = j.Notifier.Notify("pending", "Stage Preparing started")
 	wd, err := filepath.Abs(j.Fetcher.CheckoutDir())
 	if err != nil {
-		j.Logger.Printf("[E][job] %s Preparation failed: %v", j.ID, err)
+		logger.Printf("[E][job] %s Preparation failed: %v", j.ID, err)
 		_ = j.Notifier.Notify("error", "Stage Preparing failed")
+		j.runAfterFailure(ctx, "")
 		return err
 	}
 
 	if j.Manifest == nil {
-		j.Logger.Printf("[I][job] %s Looking for manifest: %v", j.ID, wd)
+		logger.Printf("[I][job] %s Looking for manifest: %v", j.ID, wd)
 		m, err := FindManifest(wd)
 		if err != nil {
-			j.Logger.Printf("[E][job] %s Failed to find valid manifest: %v", j.ID, err)
+			logger.Printf("[E][job] %s Failed to find valid manifest: %v", j.ID, err)
+			if errs, ok := err.(ManifestErrors); ok {
+				_ = j.Notifier.Notify("error", statusDescription("Invalid manifest: "+errs[0].Error()))
+			}
 			// Report no manifest found as success to Github as we can't
 			// distinguish if that was intended or not.
 			//_ = j.Notifier.Notify("success", "No manifest found")
+			j.runAfterFailure(ctx, wd)
 			return err
 		}
 		j.Manifest = m
 	}
 
-	env := j.prepareEnv(wd)
+	env, err := j.prepareEnv(wd)
+	if err != nil {
+		logger.Printf("[E][job] %s Preparation failed: %v", j.ID, err)
+		_ = j.Notifier.Notify("error", "Stage Preparing failed")
+		j.runAfterFailure(ctx, wd)
+		return err
+	}
 
-	steps := []*step{
-		&step{name: "Pre", instructions: j.Manifest.Pre},
-		&step{name: "Test", instructions: j.Manifest.Test, relevant: true},
-		&step{name: "Post", instructions: j.Manifest.Post},
+	if cells := j.Manifest.Matrix.Expand(); len(cells) > 0 {
+		j.result, err = j.runMatrix(ctx, wd, env, cells)
+		return err
 	}
+	j.result, err = j.runPipeline(ctx, wd, env)
+	return err
+}
 
-	var firstRelevantErr error
+// runAfterFailure runs the Post commands meant to run on failure, followed by
+// the Cleanup commands, of a build failing before its stages ran. Both need the
+// checkout in wd and its manifest, so they are skipped without.
+func (j *Job) runAfterFailure(ctx context.Context, wd string) {
+	if j.Manifest == nil || wd == "" {
+		j.Logger.Printf("[I][job] %s Post and Cleanup skipped: no checkout or manifest", j.ID)
+		return
+	}
+	env, err := j.prepareEnv(wd)
+	if err != nil {
+		j.Logger.Printf("[E][job] %s Post and Cleanup skipped: %v", j.ID, err)
+		return
+	}
+	defer j.cleanup(wd, env)
+
+	var commands []Command
+	for _, c := range j.Manifest.Post {
+		if c.RunsOn("error") {
+			commands = append(commands, c)
+		}
+	}
+	if len(commands) == 0 {
+		return
+	}
+	pj := *j
+	pj.Logger = j.Logger.Stage("Post")
+	pj.Logger.Printf("[I][job] %s Post started", j.ID)
+	if err := pj.ExecuteStep(ctx, commands, wd, append(env[:len(env):len(env)], "SEAEYE_TEST_RESULT=error")); err != nil {
+		pj.Logger.Printf("[E][job] %s Post failed: %v", j.ID, err)
+	} else {
+		pj.Logger.Printf("[I][job] %s Post succeeded", j.ID)
+	}
+}
 
-	for _, step := range steps {
-		j.Logger.Printf("[I][job] %s %s started", j.ID, step.name)
-		_ = j.Notifier.Notify("pending", fmt.Sprintf("Stage %s started", step.name))
-		err := j.ExecuteStep(step.instructions, wd, env)
-		j.Logger.Printf("[I][job] %s %s finished", j.ID, step.name)
+// runMatrix executes the pipeline once per matrix cell, each with its own log
+// and commit status, and reports and returns the aggregated commit state.
+func (j *Job) runMatrix(ctx context.Context, wd string, env []string, cells []*MatrixCell) (string, error) {
+	logger := j.Logger.Stage("Matrix")
+	logger.Printf("[I][job] %s Running %d matrix builds", j.ID, len(cells))
+	_ = j.Notifier.Notify("pending", fmt.Sprintf("Running %d matrix builds", len(cells)))
 
+	var failed []string
+	var firstErr error
+	result := "success"
+
+	for _, cell := range cells {
+		logger.Printf("[I][job] %s Matrix build %s started", j.ID, cell.Name)
+		state, err := j.runMatrixCell(ctx, wd, env, cell)
 		if err != nil {
-			j.Logger.Printf("[E][job] %s %s failed: %v", j.ID, step.name, err)
-			if step.relevant {
-				if firstRelevantErr == nil {
-					firstRelevantErr = err
-				}
-				if _, ok := err.(*exec.ExitError); ok {
-					_ = j.Notifier.Notify("failure", fmt.Sprintf("Stage %s failed", step.name))
-				} else {
-					_ = j.Notifier.Notify("error", fmt.Sprintf("Stage %s failed", step.name))
-				}
+			logger.Printf("[E][job] %s Matrix build %s failed: %v", j.ID, cell.Name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("matrix build %s failed: %v", cell.Name, err)
 			}
 		} else {
-			j.Logger.Printf("[I][job] %s %s succeeded", step.name, j.ID)
+			logger.Printf("[I][job] %s Matrix build %s succeeded", j.ID, cell.Name)
+		}
+		if state != "success" {
+			failed = append(failed, cell.Name)
+			if result != "failure" {
+				result = state
+			}
 		}
 	}
 
-	// Done
-	if firstRelevantErr == nil {
-		_ = j.Notifier.Notify("success", "All stages succeeded")
+	if len(failed) > 0 {
+		_ = j.Notifier.Notify(result, fmt.Sprintf("%d of %d matrix builds failed", len(failed), len(cells)))
+	} else {
+		_ = j.Notifier.Notify("success", fmt.Sprintf("All %d matrix builds succeeded", len(cells)))
 	}
-	return firstRelevantErr
+	return result, firstErr
 }
 
-// ExecuteStep executes instructions defined in a manifest step.
-func (j *Job) ExecuteStep(instructions [][]string, wd string, env []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), j.Config.ExecTimeout)
+// runMatrixCell executes the pipeline for a single matrix cell, logging to a
+// separate log file and notifying under a separate status context.
+func (j *Job) runMatrixCell(ctx context.Context, wd string, env []string, cell *MatrixCell) (string, error) {
+	logger := j.Logger
+	if !j.Logger.terminal {
+		logFilePath, err := j.Config.CellLogFilePath(j.ID, j.source.Rev, cell.Name)
+		if err != nil {
+			return "error", err
+		}
+		logger, err = NewFileLogger(logFilePath, log.Prefix(), log.LstdFlags)
+		if err != nil {
+			return "error", err
+		}
+		defer logger.Close()
+		logger.SetLimit(j.Logger.limit.bytes)
+		logger.Masker.Add(j.Logger.Masker.Secrets()...)
+		if j.Logger.Server != nil {
+			logger.Server = j.Logger.Server.With("cell", cell.Name)
+		}
+		j.Logger.Printf("[I][job] %s Created matrix build logger: %s", j.ID, logger.outFile.Name())
+	}
+
+	cj := *j
+	cj.ID = j.ID + "/" + cell.Name
+	cj.Logger = logger
+	if g, ok := j.Notifier.(*GithubNotifier); ok {
+		n := *g
+		n.Context = g.context() + "/" + cell.Name
+		n.TargetURL = j.targetURL(cell.Name)
+		cj.Notifier = &n
+	}
+
+	return cj.runPipeline(ctx, wd, mergeEnv(env, cell.Env))
+}
+
+// runPipeline executes all stages followed by the Cleanup stage, and returns
+// the resulting commit state. Only relevant stages fail the build, failures of
+// other stages are just logged. With LogLimitFail set, exceeding the log limit
+// cancels the stages, and fails them with ErrLogLimitExceeded.
+func (j *Job) runPipeline(ctx context.Context, wd string, env []string) (string, error) {
+	// Cleanup must not inherit ctx as it has to run after cancellation, too.
+	defer j.cleanup(wd, env)
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	if j.Config.LogLimitFail {
+		go func() {
+			select {
+			case <-j.Logger.LimitExceeded():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	limitWarned := false
+
+	stages, err := j.Manifest.Pipeline()
+	if err != nil {
+		j.Logger.Printf("[E][job] %s Invalid pipeline: %v", j.ID, err)
+		_ = j.Notifier.Notify("error", "Invalid pipeline")
+		return "error", err
+	}
 
-	for _, line := range instructions {
-		cmd := exec.CommandContext(ctx, line[0], line[1:]...)
-		cmd.Dir = wd
-		cmd.Env = env
-		cmd.Stdout = j.Logger.outFile
-		cmd.Stderr = j.Logger.outFile
-
-		j.Logger.Printf("[I][job] %s Running command: %v (%s)", j.ID, cmd.Args, cmd.Dir)
-		if err := cmd.Run(); err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				j.Logger.Printf("[I][job] %s Command failed: %v", j.ID, exitErr)
-			} else {
-				j.Logger.Printf("[I][job] %s Command error: %v", j.ID, err)
+	var firstRelevantErr error
+	result := "success"
+	succeeded := map[string]bool{}
+	failed := map[string]string{} // commit state of failed and skipped stages
+
+	for _, stage := range stages {
+		if !needsDone(stage, succeeded) {
+			j.Logger.Printf("[I][job] %s %s skipped: needs %v", j.ID, stage.Name, stage.Needs)
+			failed[stage.Name] = needsState(stage, failed)
+			if stage.IsRelevant() && firstRelevantErr == nil {
+				firstRelevantErr = fmt.Errorf("stage %s skipped: needs %v", stage.Name, stage.Needs)
+				result = failed[stage.Name]
+				_ = j.Notifier.Notify(result, fmt.Sprintf("Stage %s skipped", stage.Name))
 			}
+			continue
+		}
+
+		// Commands are filtered by, and exposed to, the result of the relevant
+		// stages run so far.
+		var commands []Command
+		for _, c := range stage.Commands {
+			if c.RunsOn(result) {
+				commands = append(commands, c)
+			}
+		}
+		stageEnv := append(env[:len(env):len(env)], fmt.Sprintf("SEAEYE_TEST_RESULT=%s", result))
+
+		sj := *j
+		sj.Logger = j.Logger.Stage(stage.Name)
+		sj.Logger.Printf("[I][job] %s %s started", j.ID, stage.Name)
+		if result == "success" {
+			_ = j.Notifier.Notify("pending", fmt.Sprintf("Stage %s started", stage.Name))
+		}
+		start := time.Now()
+		err := sj.ExecuteStep(ctx, commands, wd, stageEnv)
+		metricStageDuration.Observe(time.Since(start).Seconds(), path.Join(j.source.Owner, j.source.Repo), stage.Name)
+		sj.Logger.Printf("[I][job] %s %s finished", j.ID, stage.Name)
+		if !limitWarned && logLimitExceeded(j.Logger) {
+			limitWarned = true
+			sj.Logger.Printf("[W][job] %s Log limit of %d MB exceeded, output discarded", j.ID, j.Config.LogLimitMB)
+		}
+		if err != nil && j.Config.LogLimitFail && logLimitExceeded(j.Logger) {
+			err = ErrLogLimitExceeded
+		}
+
+		if err == nil {
+			sj.Logger.Printf("[I][job] %s %s succeeded", j.ID, stage.Name)
+			succeeded[stage.Name] = true
+			continue
+		}
+
+		sj.Logger.Printf("[E][job] %s %s failed: %v", j.ID, stage.Name, err)
+		if stage.AllowFailure {
+			sj.Logger.Printf("[I][job] %s %s allowed to fail", j.ID, stage.Name)
+			succeeded[stage.Name] = true
+			continue
+		}
+		failed[stage.Name] = "error"
+		if _, ok := err.(*exec.ExitError); ok || err == ErrLogLimitExceeded {
+			failed[stage.Name] = "failure"
+		}
+		if !stage.IsRelevant() {
+			sj.Logger.Printf("[I][job] %s %s not relevant, build continues", j.ID, stage.Name)
+		} else if firstRelevantErr == nil {
+			firstRelevantErr = err
+			result = failed[stage.Name]
+			_ = j.Notifier.Notify(result, fmt.Sprintf("Stage %s failed", stage.Name))
+		}
+	}
+
+	// Done
+	if firstRelevantErr != nil {
+		return result, firstRelevantErr
+	}
+	_ = j.Notifier.Notify("success", "All stages succeeded")
+	return result, nil
+}
+
+// logLimitExceeded reports if output of l got discarded for exceeding the log
+// limit.
+func logLimitExceeded(l *FileLogger) bool {
+	select {
+	case <-l.LimitExceeded():
+		return true
+	default:
+		return false
+	}
+}
+
+// cleanup runs all Cleanup commands, each regardless of the outcome of the
+// previous ones, with a fresh timeout.
+func (j *Job) cleanup(wd string, env []string) {
+	if len(j.Manifest.Cleanup) == 0 {
+		return
+	}
+
+	cj := *j
+	cj.Logger = j.Logger.Stage("Cleanup")
+	cj.Logger.Printf("[I][job] %s Cleanup started", j.ID)
+	failed := false
+	for _, c := range j.Manifest.Cleanup {
+		if err := cj.ExecuteStep(context.Background(), []Command{c}, wd, env); err != nil {
+			failed = true
+		}
+	}
+	if failed {
+		cj.Logger.Printf("[E][job] %s Cleanup failed", j.ID)
+	} else {
+		cj.Logger.Printf("[I][job] %s Cleanup succeeded", j.ID)
+	}
+}
+
+// ExecuteStep executes commands defined in a manifest step. Every step is
+// bound to the configured execution timeout.
+func (j *Job) ExecuteStep(ctx context.Context, commands []Command, wd string, env []string) error {
+	ctx, cancel := context.WithTimeout(ctx, j.repo.ExecTimeout)
+	defer cancel()
+
+	defer j.Logger.setSection(j.Logger.stage, 0)
+	for _, c := range commands {
+		j.Logger.nextCommand()
+		if err := j.executeCommand(ctx, c, wd, env, j.Logger, j.Logger.Writer(), j.Logger.ErrWriter()); err != nil {
 			return err
 		}
-		j.Logger.Printf("[I][job] %s Command succeeded.", j.ID)
 	}
 
 	return nil
 }
 
-func (j *Job) prepareEnv(wd string) (env []string) {
-	// Append only environment variables that are not meant for internal use
+// executeCommand runs a single command, or a parallel block of commands,
+// logging to logger and writing the command output to out and errOut.
+func (j *Job) executeCommand(ctx context.Context, c Command, wd string, env []string, logger lineLogger, out, errOut io.Writer) error {
+	if len(c.Parallel) > 0 {
+		return j.executeParallel(ctx, c, wd, env, logger, out, errOut)
+	}
+
+	vars, values := j.Manifest.commandVariables(), envMapping(env)
+	c = c.Expand(func(name string) (string, bool) {
+		if !vars[name] {
+			return "", false
+		}
+		return values(name)
+	})
+	argv := c.Argv(j.Manifest.ShellArgv())
+	if len(argv) == 0 || argv[0] == "" {
+		logger.Printf("[I][job] %s Command error: empty command", j.ID)
+		return fmt.Errorf("empty command")
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = wd
+	cmd.Env = env
+	cmd.Stdout = out
+	cmd.Stderr = errOut
+
+	logger.Printf("[I][job] %s Running command: %q (%s)", j.ID, cmd.Args, cmd.Dir)
+	j.heartbeat()
+	defer j.heartbeat()
+	if err := runProcessGroup(ctx, cmd); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			logger.Printf("[I][job] %s Command failed: %v", j.ID, exitErr)
+		} else {
+			logger.Printf("[I][job] %s Command error: %v", j.ID, err)
+		}
+		return err
+	}
+	logger.Printf("[I][job] %s Command succeeded.", j.ID)
+
+	return nil
+}
+
+func (j *Job) heartbeat() {
+	if j.Heartbeat != nil {
+		j.Heartbeat()
+	}
+}
+
+// runProcessGroup runs cmd in its own process group, killing the whole group
+// once ctx is done, so no child process outlives a canceled command or keeps
+// its output open.
+func runProcessGroup(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-doneCh:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// executeParallel runs all commands of a parallel block concurrently. Each
+// command's output is captured separately, framed to keep its streams apart,
+// and appended to out and errOut as its own section once all commands
+// finished. The block fails with the first failing command; with FailFast set,
+// the remaining commands get canceled right away.
+func (j *Job) executeParallel(ctx context.Context, c Command, wd string, env []string, logger lineLogger, out, errOut io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	files := make([]*os.File, 2*len(c.Parallel)) // output and frames
+	for i := range files {
+		f, err := ioutil.TempFile("", "seaeye-parallel-")
+		if err != nil {
+			return fmt.Errorf("failed to create parallel output file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		files[i] = f
+	}
+
+	// Output is masked before it reaches the temporary files.
+	writers := make([]*frameWriter, len(c.Parallel))
+	masked := make([][]*MaskWriter, len(c.Parallel)) // log, stdout, stderr
+	for i := range writers {
+		writers[i] = newFrameWriter(files[2*i], files[2*i+1])
+		j.Logger.limitFrames(writers[i])
+		for _, stream := range []string{StreamLog, StreamStdout, StreamStderr} {
+			masked[i] = append(masked[i], &MaskWriter{Masker: j.Logger.Masker, W: writers[i].stream(stream)})
+		}
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+
+	logger.Printf("[I][job] %s Running %d commands in parallel", j.ID, len(c.Parallel))
+	for i, pc := range c.Parallel {
+		wg.Add(1)
+		go func(pc Command, mw []*MaskWriter) {
+			defer wg.Done()
+			l := log.New(mw[0], logger.Prefix(), logger.Flags())
+			if err := j.executeCommand(ctx, pc, wd, env, l, mw[1], mw[2]); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					if c.FailFast {
+						cancel()
+					}
+				}
+				mu.Unlock()
+			}
+		}(pc, masked[i])
+	}
+	wg.Wait()
+
+	for i := range c.Parallel {
+		logger.Printf("[I][job] %s Parallel command %d/%d output:", j.ID, i+1, len(c.Parallel))
+		f, framesFile := files[2*i], files[2*i+1]
+		var err error
+		for _, mw := range masked[i] {
+			if ferr := mw.Flush(); err == nil {
+				err = ferr
+			}
+		}
+		if ferr := writers[i].flush(); err == nil {
+			err = ferr
+		}
+		if err == nil {
+			_, err = framesFile.Seek(0, 0)
+		}
+		if err == nil {
+			var frames []LogFrame
+			if frames, err = readFrames(framesFile); err == nil {
+				err = copyFrames(out, errOut, f, frames)
+			}
+		}
+		if err != nil {
+			logger.Printf("[E][job] %s Failed to copy parallel command output: %v", j.ID, err)
+		}
+	}
+
+	if firstErr != nil {
+		logger.Printf("[I][job] %s Parallel commands failed: %v", j.ID, firstErr)
+	}
+	return firstErr
+}
+
+// prepareEnv returns the environment of all commands: the server's own
+// environment merged with stored secrets, followed by the build variables, the
+// manifest's environment, whose values get interpolated, and manifest secrets.
+// The values of job-specific variables and secrets are masked in the log.
+func (j *Job) prepareEnv(wd string) ([]string, error) {
+	var env, jobOverrides, stored []string
+
+	// Take only environment variables that are not meant for internal use
 	// only or belong to this job.
 	jobEnv := envVarCompliant(strings.ToUpper(j.ID))
 	jobEnvPrefix := fmt.Sprintf("%s%s_", internalEnvPrefix, jobEnv)
 	for _, e := range os.Environ() {
 		if strings.HasPrefix(e, jobEnvPrefix) {
-			env = append(env, strings.TrimPrefix(e, jobEnvPrefix))
+			e = strings.TrimPrefix(e, jobEnvPrefix)
+			j.Logger.Masker.Add(strings.SplitN(e, "=", 2)[1])
+			jobOverrides = append(jobOverrides, e)
 		} else if !strings.HasPrefix(e, internalEnvPrefix) {
 			env = append(env, e)
 		}
 	}
 
+	// Stored secrets take precedence over the server's environment, but not
+	// over the more specific job overrides, and never reach forks.
+	if j.SecretStore != nil && !j.source.Fork {
+		stored = j.SecretStore.Env(j.source.Owner, j.source.Repo)
+		for _, e := range stored {
+			j.Logger.Masker.Add(strings.SplitN(e, "=", 2)[1])
+		}
+	}
+	env = mergeEnv(env, stored, jobOverrides)
+
 	// Append build-specific environment variables
-	env = append(env, fmt.Sprintf(`WORKSPACE=%s`, wd))
-	env = append(env, fmt.Sprintf(`DOCKER_WORKSPACE=%s`, path.Join(j.Config.DockerHostVolumeBaseDir, wd)))
+	env = append(env, j.buildEnv(wd)...)
 
 	// Append manifest environment variables
-	env = append(env, j.Manifest.Environment...)
+	for _, e := range j.Manifest.Environment {
+		env = append(env, interpolate(e, envMapping(env)))
+	}
+
+	secrets, err := j.decryptSecrets()
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, secrets...)
+
+	return env, nil
+}
+
+// decryptSecrets returns the manifest secrets as environment variables.
+// Secrets are only available to builds of the repository they were encrypted
+// for, and never to builds from forks.
+func (j *Job) decryptSecrets() ([]string, error) {
+	if len(j.Manifest.Secrets) == 0 {
+		return nil, nil
+	}
+	if j.source.Fork {
+		j.Logger.Printf("[W][job] %s Secrets not available to forks", j.ID)
+		return nil, nil
+	}
+	if j.SecretKey == nil {
+		j.Logger.Printf("[W][job] %s Secrets not available without secret key", j.ID)
+		return nil, nil
+	}
 
-	return env
+	names := make([]string, 0, len(j.Manifest.Secrets))
+	for name := range j.Manifest.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	repo := path.Join(j.source.Owner, j.source.Repo)
+	var env []string
+	for _, name := range names {
+		v, err := j.SecretKey.Decrypt(repo, j.Manifest.Secrets[name])
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %v", name, err)
+		}
+		j.Logger.Masker.Add(v)
+		env = append(env, name+"="+v)
+	}
+	return env, nil
+}
+
+// mergeEnv merges lists of environment variables, with later values taking
+// precedence over earlier ones of the same name.
+func mergeEnv(envs ...[]string) []string {
+	var merged []string
+	index := map[string]int{}
+	for _, env := range envs {
+		for _, e := range env {
+			name := strings.SplitN(e, "=", 2)[0]
+			if i, ok := index[name]; ok {
+				merged[i] = e
+				continue
+			}
+			index[name] = len(merged)
+			merged = append(merged, e)
+		}
+	}
+	return merged
 }
 
 var posixEnvVarPattern = regexp.MustCompile(`[A-Z_]+[0-9A-Z_]+`)
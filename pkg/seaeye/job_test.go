@@ -0,0 +1,271 @@
+package seaeye
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// newTestJob returns a job running commands of m in a temporary checkout,
+// logging to a temporary file whose content output returns.
+func newTestJob(t *testing.T, m *Manifest) (j *Job, wd string, output func() string) {
+	wd, err := ioutil.TempDir("", "seaeye-job-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "seaeye-job-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j = &Job{
+		Config:   &Config{},
+		ID:       "scraperwiki_seaeye",
+		Logger:   NewTerminalLogger(f, "", 0),
+		Manifest: m,
+		Notifier: &recordingNotifier{},
+		repo:     &RepoConfig{ExecTimeout: time.Minute},
+		source:   &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "abc"},
+	}
+	return j, wd, func() string {
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+}
+
+// removeTestJob removes the checkout and log of a job made by newTestJob.
+func removeTestJob(j *Job, wd string) {
+	j.Logger.outFile.Close()
+	os.Remove(j.Logger.outFile.Name())
+	os.RemoveAll(wd)
+}
+
+// failingFetcher fails to fetch, leaving a checkout behind.
+type failingFetcher struct {
+	LocalFetcher
+}
+
+func (f *failingFetcher) Fetch() error {
+	return fmt.Errorf("fetch failed")
+}
+
+func TestJobPostAfterFetchFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seaeye-job-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+
+	n := &recordingNotifier{}
+	j := &Job{
+		Config:  &Config{ExecTimeout: time.Minute},
+		Fetcher: &failingFetcher{LocalFetcher{Dir: dir}},
+		Logger:  NewTerminalLogger(devNull, "", log.LstdFlags),
+		Manifest: &Manifest{
+			Post: []Command{
+				{Script: "echo $SEAEYE_TEST_RESULT > failure", When: WhenOnFailure},
+				{Script: "touch success", When: WhenOnSuccess},
+			},
+			Cleanup: []Command{{Script: "touch cleanup"}},
+		},
+		Notifier: n,
+	}
+	err = j.Execute(&Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "abc"})
+	assert.EqualError(t, err, "fetch failed")
+	assert.Equal(t, []string{"error: Stage Fetching failed"}, n.states)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "failure"))
+	assert.NoError(t, err)
+	assert.Equal(t, "error\n", string(b))
+	assert.False(t, exists(filepath.Join(dir, "success")))
+	assert.True(t, exists(filepath.Join(dir, "cleanup")))
+}
+
+func TestJobPostConditions(t *testing.T) {
+	m, err := ParseManifest([]byte(`
+test:
+  - "false"
+post:
+  - {run: "echo $SEAEYE_TEST_RESULT > failure", post: on_failure}
+  - {run: touch success, post: on_success}
+  - {run: touch always, post: always}
+  - "false"
+  - touch after
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	j, wd, output := newTestJob(t, m)
+	defer removeTestJob(j, wd)
+
+	result, err := j.runPipeline(context.Background(), wd, os.Environ())
+	assert.Error(t, err)
+	assert.Equal(t, "failure", result)
+	assert.Equal(t, []string{"pending: Stage Pre started", "pending: Stage Test started", "failure: Stage Test failed"}, j.Notifier.(*recordingNotifier).states)
+
+	b, err := ioutil.ReadFile(filepath.Join(wd, "failure"))
+	assert.NoError(t, err)
+	assert.Equal(t, "failure\n", string(b))
+	assert.False(t, exists(filepath.Join(wd, "success")))
+	assert.True(t, exists(filepath.Join(wd, "always")))
+	assert.False(t, exists(filepath.Join(wd, "after")))
+	assert.Contains(t, output(), "Post failed")
+}
+
+func TestJobScriptVariables(t *testing.T) {
+	j, wd, _ := newTestJob(t, &Manifest{})
+	defer removeTestJob(j, wd)
+
+	// Values reach scripts through the environment, never as shell code.
+	branch := `x"$(touch pwned)";touch pwned2`
+	env := append(os.Environ(), "SEAEYE_BRANCH="+branch)
+	err := j.ExecuteStep(context.Background(), []Command{
+		{Script: `printf %s "${SEAEYE_BRANCH}" > branch`},
+		{Args: []string{"sh", "-c", `printf %s "$1" > arg`, "sh", "${SEAEYE_BRANCH}"}},
+	}, wd, env)
+	assert.NoError(t, err)
+	for _, name := range []string{"branch", "arg"} {
+		b, err := ioutil.ReadFile(filepath.Join(wd, name))
+		assert.NoError(t, err)
+		assert.Equal(t, branch, string(b), name)
+	}
+	assert.False(t, exists(filepath.Join(wd, "pwned")))
+	assert.False(t, exists(filepath.Join(wd, "pwned2")))
+}
+
+func TestJobCommandMasked(t *testing.T) {
+	secret := "a\"b\\c\nd\u00e9\x01"
+	j, wd, output := newTestJob(t, &Manifest{Secrets: map[string]string{"TOKEN": ""}})
+	defer removeTestJob(j, wd)
+	j.Logger.Masker.Add(secret)
+
+	env := append(os.Environ(), "TOKEN="+secret)
+	assert.NoError(t, j.ExecuteStep(context.Background(), []Command{{Args: []string{"true", "${TOKEN}"}}}, wd, env))
+	out := output()
+	assert.Contains(t, out, `Running command: ["true" "***"]`)
+	assert.NotContains(t, out, fmt.Sprintf("%q", secret))
+}
+
+func TestJobEnvPrecedence(t *testing.T) {
+	j, wd, _ := newTestJob(t, &Manifest{})
+	defer removeTestJob(j, wd)
+
+	store, err := OpenSecretStore(filepath.Join(wd, "secrets.enc"), testSecretStoreKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, secret := range [][3]string{
+		{"", "TOKEN", "global"},
+		{"scraperwiki", "OWNER_TOKEN", "owner"},
+		{"", "STORED", "stored"},
+	} {
+		_, err := store.Set(secret[0], secret[1], secret[2])
+		assert.NoError(t, err)
+	}
+	j.SecretStore = store
+	for k, v := range map[string]string{
+		"TOKEN":                                 "server",
+		"STORED":                                "server",
+		"SEAEYE_SCRAPERWIKI_SEAEYE_TOKEN":       "job",
+		"SEAEYE_SCRAPERWIKI_SEAEYE_OWNER_TOKEN": "job",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	env, err := j.prepareEnv(wd)
+	assert.NoError(t, err)
+	values := envMapping(env)
+	for name, want := range map[string]string{"TOKEN": "job", "OWNER_TOKEN": "job", "STORED": "stored"} {
+		v, _ := values(name)
+		assert.Equal(t, want, v, name)
+	}
+}
+
+func TestJobParallel(t *testing.T) {
+	j, wd, output := newTestJob(t, &Manifest{})
+	defer removeTestJob(j, wd)
+	j.Logger.Masker.Add("hunter2")
+
+	// Each member's output is appended as a whole, masked.
+	err := j.ExecuteStep(context.Background(), []Command{{Parallel: []Command{
+		{Script: "echo a1; sleep 0.2; echo a2 hunter2; sleep 0.2; echo a3"},
+		{Script: "sleep 0.1; echo b1; sleep 0.2; echo b2 >&2"},
+	}}}, wd, os.Environ())
+	assert.NoError(t, err)
+	out := output()
+	assert.Contains(t, out, "Parallel command 1/2 output:\n")
+	assert.Contains(t, out, "a1\na2 ***\na3\n")
+	assert.Contains(t, out, "b1\nb2\n")
+	assert.True(t, strings.Index(out, "a3") < strings.Index(out, "Parallel command 2/2 output:"))
+	assert.NotContains(t, out, "hunter2")
+
+	// The block fails if any member fails.
+	err = j.ExecuteStep(context.Background(), []Command{{Parallel: []Command{
+		{Script: "sleep 0.2; touch done"},
+		{Args: []string{"false"}},
+	}}}, wd, os.Environ())
+	assert.Error(t, err)
+	assert.True(t, exists(filepath.Join(wd, "done")), "members run to the end")
+
+	// With fail_fast, the other members get canceled.
+	start := time.Now()
+	err = j.ExecuteStep(context.Background(), []Command{{FailFast: true, Parallel: []Command{
+		{Script: "sleep 5; touch late"},
+		{Args: []string{"false"}},
+	}}}, wd, os.Environ())
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 4*time.Second, "canceled right away")
+	assert.False(t, exists(filepath.Join(wd, "late")))
+}
+
+func TestJobScripts(t *testing.T) {
+	m, err := ParseManifest([]byte(`test:
+  - |
+    echo one > lines
+    false
+    echo two >> lines
+  - ["sh", "-c", "echo argv > argv"]
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	j, wd, output := newTestJob(t, m)
+	defer removeTestJob(j, wd)
+
+	// The default shell stops at the first failing line.
+	err = j.ExecuteStep(context.Background(), m.Test, wd, os.Environ())
+	assert.Error(t, err)
+	b, _ := ioutil.ReadFile(filepath.Join(wd, "lines"))
+	assert.Equal(t, "one\n", string(b))
+	assert.False(t, exists(filepath.Join(wd, "argv")))
+	assert.Contains(t, output(), `Running command: ["sh" "-e" "-c" "echo one > lines\nfalse\necho two >> lines\n"]`)
+
+	// A custom shell runs scripts as configured.
+	m.Shell = []string{"env", "CUSTOM=yes", "sh", "-c"}
+	err = j.ExecuteStep(context.Background(), m.Test, wd, os.Environ())
+	assert.NoError(t, err)
+	b, _ = ioutil.ReadFile(filepath.Join(wd, "lines"))
+	assert.Equal(t, "one\ntwo\n", string(b))
+	assert.True(t, exists(filepath.Join(wd, "argv")))
+
+	err = j.ExecuteStep(context.Background(), []Command{{Script: "echo $CUSTOM > custom"}}, wd, os.Environ())
+	assert.NoError(t, err)
+	b, _ = ioutil.ReadFile(filepath.Join(wd, "custom"))
+	assert.Equal(t, "yes\n", string(b))
+}
@@ -6,33 +6,231 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
 )
 
-// FileLogger is a log holding a reference to a file meant to log to.
+// FileLogger is a log holding a reference to a file meant to log to. All
+// output is masked by its Masker. Output to a file is framed, see LogFrame.
 type FileLogger struct {
 	*log.Logger
-	outFile *os.File
+	Masker *Masker
+	// Server receives the lines logged via Printf as records, if set.
+	Server     *Logger
+	commands   *int // commands run in stage so far
+	errOut     *MaskWriter
+	frames     *frameWriter
+	framesFile *os.File
+	limit      *logLimit
+	logOut     *MaskWriter
+	out        *MaskWriter
+	outFile    *os.File
+	stage      string
+	terminal   bool
 }
 
-// NewFileLogger instantiates a new file logger which additionally to the
-// standard logger behaviour also logs to a file. The caller is responsible for
-// closing the file handle.
+// logLimit holds the size limit of a log file and signals exceeding it.
+type logLimit struct {
+	bytes    int64
+	once     sync.Once
+	exceeded chan struct{}
+}
+
+func newLogLimit() *logLimit {
+	return &logLimit{exceeded: make(chan struct{})}
+}
+
+func (l *logLimit) exceed() {
+	l.once.Do(func() { close(l.exceeded) })
+}
+
+// lineLogger is implemented by *log.Logger and *FileLogger.
+type lineLogger interface {
+	Printf(format string, v ...interface{})
+	Prefix() string
+	Flags() int
+}
+
+// levelPrefix matches the level and component prefix of a log line, e.g.
+// "[I][job] ".
+var levelPrefix = regexp.MustCompile(`^\[([DIWE])\]\[[a-z_]+\] `)
+
+// NewFileLogger instantiates a new file logger which logs to a file, and its
+// frames to the file's frames file. The caller is responsible for closing the
+// file handles.
 func NewFileLogger(filePath, prefix string, flag int) (*FileLogger, error) {
 	logFile, err := createFile(filePath)
 	if err != nil {
 		return nil, err
 	}
+	framesFile, err := createFile(FramesFilePath(filePath))
+	// Compressed logs and search indexes are of a previous build of the same
+	// revision.
+	stale := []string{filePath + ".gz", FramesFilePath(filePath) + ".gz", filepath.Join(filepath.Dir(filePath), searchIndexFile)}
+	for _, p := range stale {
+		if rerr := os.Remove(p); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
 
-	w := io.MultiWriter(os.Stderr, logFile)
+	m := &Masker{}
+	frames := newFrameWriter(logFile, framesFile)
+	logOut := &MaskWriter{Masker: m, W: frames.stream(StreamLog)}
+	out := &MaskWriter{Masker: m, W: frames.stream(StreamStdout)}
+	errOut := &MaskWriter{Masker: m, W: frames.stream(StreamStderr)}
 
 	logger := &FileLogger{
-		Logger:  log.New(w, prefix, flag),
-		outFile: logFile,
+		Logger:     log.New(logOut, prefix, flag),
+		Masker:     m,
+		errOut:     errOut,
+		frames:     frames,
+		framesFile: framesFile,
+		limit:      newLogLimit(),
+		logOut:     logOut,
+		out:        out,
+		outFile:    logFile,
 	}
 
 	return logger, nil
 }
 
+// NewTerminalLogger instantiates a new logger which logs to a terminal, e.g.
+// os.Stdout, instead of a file. Closing the logger leaves the terminal open.
+func NewTerminalLogger(f *os.File, prefix string, flag int) *FileLogger {
+	m := &Masker{}
+	out := &MaskWriter{Masker: m, W: f}
+	return &FileLogger{
+		Logger:   log.New(out, prefix, flag),
+		Masker:   m,
+		errOut:   &MaskWriter{Masker: m, W: f},
+		limit:    newLogLimit(),
+		logOut:   out,
+		out:      out,
+		outFile:  f,
+		terminal: true,
+	}
+}
+
+// Printf logs a line like log.Printf does and passes it on to Server, at the
+// level of its prefix, e.g. "[W][job] ".
+func (l *FileLogger) Printf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	_ = l.out.Flush()
+	_ = l.errOut.Flush()
+	_ = l.Output(2, msg)
+	if l.Server == nil {
+		return
+	}
+	level := LevelInfo
+	if m := levelPrefix.FindStringSubmatch(msg); m != nil {
+		msg = msg[len(m[0]):]
+		level = map[string]LogLevel{"D": LevelDebug, "I": LevelInfo, "W": LevelWarn, "E": LevelError}[m[1]]
+	}
+	l.Server.logf(level, "%s", l.Masker.Mask(msg))
+}
+
+// With returns a logger sharing the log file of l, passing lines on to Server
+// with the given fields added. Only l itself needs to be closed.
+func (l *FileLogger) With(kv ...interface{}) *FileLogger {
+	c := *l
+	if l.Server != nil {
+		c.Server = l.Server.With(kv...)
+	}
+	return &c
+}
+
+// Stage returns a logger tagging all output as belonging to a stage, until
+// the next call to Stage, and passing lines on to Server with the stage added.
+func (l *FileLogger) Stage(name string) *FileLogger {
+	c := l.With("stage", name)
+	c.stage = name
+	c.commands = new(int)
+	c.setSection(name, 0)
+	return c
+}
+
+// nextCommand tags all following output as belonging to the next command of
+// the stage.
+func (l *FileLogger) nextCommand() {
+	if l.commands == nil {
+		l.commands = new(int)
+	}
+	*l.commands++
+	l.setSection(l.stage, *l.commands)
+}
+
+func (l *FileLogger) setSection(stage string, command int) {
+	if l.frames == nil {
+		return
+	}
+	_ = l.out.Flush()
+	_ = l.errOut.Flush()
+	_ = l.logOut.Flush()
+	l.frames.setSection(stage, command)
+}
+
+// SetLimit limits the log file to about limit bytes, keeping the head and a
+// rolling tail of its output, see frameWriter.setLimit. 0 disables the limit.
+// Logging to a terminal is not limited.
+func (l *FileLogger) SetLimit(limit int64) {
+	l.limit.bytes = limit
+	l.limitFrames(l.frames)
+}
+
+// limitFrames applies the limit of the log file to a frameWriter, e.g. one
+// capturing output to be copied to the log later.
+func (l *FileLogger) limitFrames(f *frameWriter) {
+	if f != nil && l.limit.bytes > 0 {
+		f.setLimit(l.limit.bytes, l.limit.exceed)
+	}
+}
+
+// LimitExceeded returns a channel which gets closed once output got discarded
+// for exceeding the limit of the log file.
+func (l *FileLogger) LimitExceeded() <-chan struct{} {
+	return l.limit.exceeded
+}
+
+// Writer returns the masked writer to the log file, e.g. for command output.
+func (l *FileLogger) Writer() io.Writer {
+	return l.out
+}
+
+// ErrWriter returns the masked writer to the log file for error output, e.g.
+// a command's stderr.
+func (l *FileLogger) ErrWriter() io.Writer {
+	return l.errOut
+}
+
+// Close flushes the masked output and the tail of a log exceeding its limit,
+// and closes the log file.
+func (l *FileLogger) Close() error {
+	err := l.out.Flush()
+	for _, w := range []*MaskWriter{l.errOut, l.logOut} {
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	if l.terminal {
+		return err
+	}
+	if ferr := l.frames.flush(); err == nil {
+		err = ferr
+	}
+	if cerr := l.outFile.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := l.framesFile.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func createFile(logFilePath string) (*os.File, error) {
 	if err := os.MkdirAll(path.Dir(logFilePath), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directories: %v", err)
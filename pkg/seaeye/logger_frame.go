@@ -0,0 +1,281 @@
+package seaeye
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Streams of a build log.
+const (
+	StreamLog    = "log" // seaeye's own messages
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// LogFrame tags a chunk of a build log file, Length bytes at Offset, with the
+// time it got written, its stream, and the stage and command producing it.
+type LogFrame struct {
+	Time    time.Time `json:"time"`
+	Stream  string    `json:"stream"`
+	Stage   string    `json:"stage,omitempty"`
+	Command int       `json:"command,omitempty"` // 1-based index within Stage
+	Offset  int64     `json:"offset"`
+	Length  int       `json:"length"`
+}
+
+// FramesFilePath returns the path of the frames file of a log file.
+func FramesFilePath(logFilePath string) string {
+	return filepath.Join(filepath.Dir(logFilePath), "frames.jsonl")
+}
+
+// ReadFrames reads the frames of a log file, one JSON object per line, from
+// its frames file or its compressed version. A trailing partial frame of a log
+// still being written is ignored.
+func ReadFrames(logFilePath string) ([]LogFrame, error) {
+	b, err := readLogFile(FramesFilePath(logFilePath))
+	if err != nil {
+		return nil, err
+	}
+	return readFrames(bytes.NewReader(b))
+}
+
+func readFrames(r io.Reader) ([]LogFrame, error) {
+	var frames []LogFrame
+	dec := json.NewDecoder(r)
+	for {
+		var frame LogFrame
+		err := dec.Decode(&frame)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// frameReader reads the frames of a log still being written, holding back a
+// trailing partial frame until it is complete.
+type frameReader struct {
+	r       *bufio.Reader
+	partial []byte
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: bufio.NewReader(r)}
+}
+
+// read returns the frames written completely since the last call.
+func (fr *frameReader) read() ([]LogFrame, error) {
+	var frames []LogFrame
+	for {
+		line, err := fr.r.ReadBytes('\n')
+		fr.partial = append(fr.partial, line...)
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		var frame LogFrame
+		if err := json.Unmarshal(fr.partial, &frame); err != nil {
+			return frames, err
+		}
+		fr.partial = nil
+		frames = append(frames, frame)
+	}
+}
+
+// copyFrames copies the chunks of a framed log to the writer of their stream,
+// with stderr chunks going to stderr and all others to stdout.
+func copyFrames(stdout, stderr io.Writer, r io.ReaderAt, frames []LogFrame) error {
+	for _, f := range frames {
+		b := make([]byte, f.Length)
+		if _, err := r.ReadAt(b, f.Offset); err != nil {
+			return err
+		}
+		w := stdout
+		if f.Stream == StreamStderr {
+			w = stderr
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logTailMax holds the maximum size of the tail of a log exceeding its limit
+// kept in memory, see frameWriter.setLimit.
+const logTailMax = 1 << 20
+
+// frameWriter writes to a log file and records every write as a LogFrame in a
+// frames file.
+type frameWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	enc     *json.Encoder
+	offset  int64
+	last    byte // last byte written
+	stage   string
+	command int
+
+	head      int64 // bytes written before keeping the tail, 0 for no limit
+	tailSize  int
+	tail      []tailChunk
+	tailLen   int
+	discarded int64
+	exceeded  func()
+}
+
+// tailChunk holds a write kept in the tail of a log exceeding its limit.
+type tailChunk struct {
+	frame LogFrame
+	data  []byte
+}
+
+func newFrameWriter(w, frames io.Writer) *frameWriter {
+	return &frameWriter{w: w, enc: json.NewEncoder(frames)}
+}
+
+// stream returns a writer whose writes are tagged with the stream name.
+func (f *frameWriter) stream(name string) io.Writer {
+	return &streamWriter{frames: f, name: name}
+}
+
+// setSection tags all following writes with a stage and command index, 0 for
+// none.
+func (f *frameWriter) setSection(stage string, command int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stage, f.command = stage, command
+}
+
+// setLimit limits the log to about limit bytes: once its head is written, only
+// a rolling tail of the following writes is kept, up to half of limit or
+// logTailMax, to be written by flush. exceeded is called once output first
+// gets discarded.
+func (f *frameWriter) setLimit(limit int64, exceeded func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tailSize = int(limit / 2)
+	if f.tailSize > logTailMax {
+		f.tailSize = logTailMax
+	}
+	f.head = limit - int64(f.tailSize)
+	f.exceeded = exceeded
+}
+
+func (f *frameWriter) write(stream string, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	frame := LogFrame{
+		Time:    time.Now().UTC(),
+		Stream:  stream,
+		Stage:   f.stage,
+		Command: f.command,
+	}
+	if f.head == 0 || f.offset+int64(len(p)) <= f.head {
+		return f.writeFrame(frame, p)
+	}
+
+	n := f.head - f.offset
+	if n < 0 {
+		n = 0
+	}
+	if n > 0 {
+		if written, err := f.writeFrame(frame, p[:n]); err != nil {
+			return written, err
+		}
+	}
+	f.keepTail(frame, p[n:])
+	return len(p), nil
+}
+
+func (f *frameWriter) writeFrame(frame LogFrame, p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if n > 0 {
+		frame.Offset = f.offset
+		frame.Length = n
+		f.offset += int64(n)
+		f.last = p[n-1]
+		if ferr := f.enc.Encode(frame); err == nil {
+			err = ferr
+		}
+	}
+	return n, err
+}
+
+// keepTail adds a write to the tail, discarding the oldest output beyond
+// tailSize.
+func (f *frameWriter) keepTail(frame LogFrame, p []byte) {
+	f.tail = append(f.tail, tailChunk{frame: frame, data: append([]byte(nil), p...)})
+	f.tailLen += len(p)
+	for f.tailLen > f.tailSize {
+		excess := f.tailLen - f.tailSize
+		c := &f.tail[0]
+		if len(c.data) > excess {
+			c.data = c.data[excess:]
+		} else {
+			excess = len(c.data)
+			f.tail = f.tail[1:]
+		}
+		f.tailLen -= excess
+		if f.discarded == 0 && f.exceeded != nil {
+			f.exceeded()
+		}
+		f.discarded += int64(excess)
+	}
+}
+
+// flush writes the tail kept of a log exceeding its limit. If output got
+// discarded, the tail starts at its first complete line, preceded by a marker
+// telling how much got discarded.
+func (f *frameWriter) flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tail := f.tail
+	f.tail, f.tailLen = nil, 0
+	if f.discarded > 0 && len(tail) > 0 {
+		c := &tail[0]
+		if i := bytes.IndexByte(c.data, '\n'); i >= 0 && i < len(c.data)-1 {
+			c.data = c.data[i+1:]
+			f.discarded += int64(i + 1)
+		}
+
+		marker := fmt.Sprintf("[log limit exceeded: %d bytes discarded]\n", f.discarded)
+		if f.offset > 0 && f.last != '\n' {
+			marker = "\n" + marker
+		}
+		frame := c.frame
+		frame.Stream = StreamLog
+		if _, err := f.writeFrame(frame, []byte(marker)); err != nil {
+			return err
+		}
+		f.discarded = 0
+	}
+	for _, c := range tail {
+		if _, err := f.writeFrame(c.frame, c.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type streamWriter struct {
+	frames *frameWriter
+	name   string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	return w.frames.write(w.name, p)
+}
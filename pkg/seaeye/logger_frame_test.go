@@ -0,0 +1,61 @@
+package seaeye
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameReader(t *testing.T) {
+	var log, frames bytes.Buffer
+	f := newFrameWriter(&log, &frames)
+	io.WriteString(f.stream(StreamStdout), "out\n")
+	io.WriteString(f.stream(StreamStderr), "err\n")
+
+	// The second frame is only partially written yet.
+	b := frames.Bytes()
+	fr := newFrameReader(bytes.NewReader(b[:len(b)-5]))
+	read, err := fr.read()
+	assert.NoError(t, err)
+	assert.Len(t, read, 1)
+	fr.r.Reset(bytes.NewReader(b[len(b)-5:]))
+	more, err := fr.read()
+	assert.NoError(t, err)
+	if !assert.Len(t, more, 1) {
+		return
+	}
+	assert.Equal(t, StreamStderr, more[0].Stream)
+
+	var out bytes.Buffer
+	assert.NoError(t, writeLogEntries(&out, strings.NewReader(log.String()), append(read, more...), false, StreamStderr))
+	assert.Equal(t, "err\n", out.String())
+}
+
+func TestFrameWriterLimit(t *testing.T) {
+	var log, frames bytes.Buffer
+	f := newFrameWriter(&log, &frames)
+	exceeded := 0
+	f.setLimit(28, func() { exceeded++ })
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(f.stream(StreamStdout), "line %d\n", i)
+	}
+	assert.Equal(t, "line 0\nline 1\n", log.String())
+	assert.Equal(t, 0, exceeded)
+
+	for i := 4; i < 10; i++ {
+		fmt.Fprintf(f.stream(StreamStdout), "line %d\n", i)
+	}
+	assert.Equal(t, 1, exceeded)
+	assert.NoError(t, f.flush())
+	assert.Equal(t, "line 0\nline 1\n[log limit exceeded: 42 bytes discarded]\nline 8\nline 9\n", log.String())
+
+	read, err := readFrames(&frames)
+	assert.NoError(t, err)
+	var out bytes.Buffer
+	assert.NoError(t, writeLogEntries(&out, strings.NewReader(log.String()), read, false, StreamStdout))
+	assert.Equal(t, "line 0\nline 1\nline 8\nline 9\n", out.String())
+}
@@ -0,0 +1,168 @@
+package seaeye
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// minSecretLength defines the length below which values are not masked, as
+// masking them would garble the log without protecting much.
+const minSecretLength = 4
+
+// secretMask replaces secrets in log output.
+var secretMask = []byte("***")
+
+// Masker holds the secrets to be masked in log output, together with their
+// common encodings.
+type Masker struct {
+	mu       sync.RWMutex
+	secrets  []string
+	patterns [][]byte // longest first
+}
+
+// Add adds secrets to be masked. Values shorter than minSecretLength are
+// ignored.
+func (m *Masker) Add(secrets ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Patterns are replaced rather than modified, as writers use them
+	// without holding the lock.
+	patterns := append([][]byte{}, m.patterns...)
+	for _, s := range secrets {
+		if len(s) < minSecretLength || containsString(m.secrets, s) {
+			continue
+		}
+		m.secrets = append(m.secrets, s)
+		for _, p := range secretEncodings(s) {
+			if len(p) >= minSecretLength {
+				patterns = append(patterns, []byte(p))
+			}
+		}
+	}
+	sort.Stable(byLengthDesc(patterns))
+	m.patterns = patterns
+}
+
+// Secrets returns all secrets added.
+func (m *Masker) Secrets() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string{}, m.secrets...)
+}
+
+// Mask returns s with all secrets replaced by "***".
+func (m *Masker) Mask(s string) string {
+	var b bytes.Buffer
+	w := &MaskWriter{Masker: m, W: &b}
+	_, _ = w.Write([]byte(s))
+	_ = w.Flush()
+	return b.String()
+}
+
+// secretEncodings returns a secret as is, and in the encodings it is likely to
+// be printed in.
+func secretEncodings(s string) []string {
+	encodings := []string{s}
+	if q := url.QueryEscape(s); q != s {
+		encodings = append(encodings, q)
+	}
+	// Commands are logged quoted, see executeCommand.
+	if q := strconv.Quote(s); q[1:len(q)-1] != s {
+		encodings = append(encodings, q[1:len(q)-1])
+	}
+
+	// A secret embedded in a longer base64 encoded value is encoded
+	// differently depending on its offset, so all three alignments are
+	// covered, leaving out the characters shared with surrounding bytes.
+	for offset := 0; offset < 3; offset++ {
+		b := append(make([]byte, offset), s...)
+		start := (offset*8 + 5) / 6
+		end := len(b) * 8 / 6
+		for _, enc := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+			encoded := enc.EncodeToString(b)
+			if start < end {
+				encodings = append(encodings, encoded[start:end])
+			}
+		}
+	}
+	return encodings
+}
+
+type byLengthDesc [][]byte
+
+func (b byLengthDesc) Len() int           { return len(b) }
+func (b byLengthDesc) Less(i, j int) bool { return len(b[i]) > len(b[j]) }
+func (b byLengthDesc) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// MaskWriter replaces all secrets of its Masker written to it by "***" before
+// writing to W. Output that could be the beginning of a secret is held back
+// until the next write or Flush, so secrets split across writes are masked,
+// too.
+type MaskWriter struct {
+	Masker  *Masker
+	W       io.Writer
+	mu      sync.Mutex
+	pending []byte
+}
+
+// Write masks and writes p, except for a trailing partial secret.
+func (w *MaskWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.Masker.mu.RLock()
+	patterns := w.Masker.patterns
+	w.Masker.mu.RUnlock()
+
+	if len(patterns) == 0 && len(w.pending) == 0 {
+		return w.W.Write(p)
+	}
+
+	data := append(w.pending, p...)
+	w.pending = nil
+
+	var out []byte
+	i := 0
+scan:
+	for i < len(data) {
+		for _, pattern := range patterns {
+			if bytes.HasPrefix(data[i:], pattern) {
+				out = append(out, secretMask...)
+				i += len(pattern)
+				continue scan
+			}
+		}
+		for _, pattern := range patterns {
+			if len(data)-i < len(pattern) && bytes.HasPrefix(pattern, data[i:]) {
+				w.pending = append([]byte{}, data[i:]...)
+				break scan
+			}
+		}
+		out = append(out, data[i])
+		i++
+	}
+
+	if _, err := w.W.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes any held back output.
+func (w *MaskWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.W.Write(w.pending)
+	w.pending = nil
+	return err
+}
@@ -0,0 +1,36 @@
+package seaeye
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskWriter(t *testing.T) {
+	m := &Masker{}
+	m.Add("hunter2", "s3cr3t!", "x")
+
+	var buf bytes.Buffer
+	w := &MaskWriter{Masker: m, W: &buf}
+	fmt.Fprintln(w, "password: hunter2, again: hunter2")
+	fmt.Fprint(w, "split: hun")
+	fmt.Fprint(w, "ter2, almost: hunt")
+	fmt.Fprintln(w, "er3 x")
+	fmt.Fprintln(w, "encoded:", base64.StdEncoding.EncodeToString([]byte("user:s3cr3t!")))
+	fmt.Fprintln(w, "escaped: s3cr3t%21")
+	fmt.Fprintf(w, "quoted: %q\n", "s3cr3t!")
+	fmt.Fprint(w, "trailing: hunt")
+	assert.NoError(t, w.Flush())
+
+	out := buf.String()
+	assert.NotContains(t, out, "hunter2")
+	assert.Equal(t, "password: ***, again: ***\n", out[:26])
+	assert.Contains(t, out, "split: ***, almost: hunter3 x\n")
+	assert.Contains(t, out, "encoded: dXNlcjp***\n")
+	assert.Contains(t, out, "escaped: ***\n")
+	assert.Contains(t, out, "quoted: \"***\"\n")
+	assert.Contains(t, out, "trailing: hunt")
+}
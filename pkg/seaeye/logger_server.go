@@ -0,0 +1,256 @@
+package seaeye
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogLevel defines the severity of a server log record.
+type LogLevel int32
+
+// Log levels, in increasing order of severity.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return logLevelNames[l]
+}
+
+// letter returns the level's abbreviation used by the text format, e.g. "I".
+func (l LogLevel) letter() string {
+	return strings.ToUpper(l.String()[:1])
+}
+
+// ParseLogLevel parses a log level name, e.g. "info".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.ToLower(s) == name {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of: %s", s, strings.Join(logLevelNames, ", "))
+}
+
+// Log formats.
+const (
+	LogFormatText   = "text"
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+var logFormats = []string{LogFormatText, LogFormatJSON, LogFormatLogfmt}
+
+// ServerLog is the root logger of the server. Its level and format apply to
+// all loggers derived from it.
+var ServerLog = NewLogger(nil)
+
+// Component loggers.
+var (
+	appLog      = ServerLog.Named("app")
+	configLog   = ServerLog.Named("config")
+	fetcherLog  = ServerLog.Named("fetcher_github")
+	jobLog      = ServerLog.Named("job")
+	notifierLog = ServerLog.Named("notifier_github")
+	secretLog   = ServerLog.Named("secret")
+	triggerLog  = ServerLog.Named("trigger_hookbot")
+	webLog      = ServerLog.Named("web")
+)
+
+// Logger writes leveled log records with a component and fields, as text in
+// the form "[I][component] message key=value", as JSON objects, or as logfmt
+// lines, one record per line.
+type Logger struct {
+	component string
+	fields    []interface{} // key, value pairs
+	out       *logOutput
+}
+
+// logOutput holds the settings and writer shared by a logger and all loggers
+// derived from it.
+type logOutput struct {
+	level  int32 // LogLevel, accessed atomically
+	mu     sync.Mutex
+	format string
+	w      io.Writer
+}
+
+// NewLogger instantiates a logger writing text records of level info and above
+// to w. If w is nil, records go to the standard logger, or to os.Stderr in
+// JSON and logfmt format.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{out: &logOutput{level: int32(LevelInfo), format: LogFormatText, w: w}}
+}
+
+// Named returns a logger for a component sharing the output of l.
+func (l *Logger) Named(component string) *Logger {
+	return &Logger{component: component, fields: l.fields, out: l.out}
+}
+
+// With returns a logger adding the given key, value pairs to every record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{component: l.component, fields: fields, out: l.out}
+}
+
+// Level returns the minimum level of records written.
+func (l *Logger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.out.level))
+}
+
+// SetLevel sets the minimum level of records written.
+func (l *Logger) SetLevel(level LogLevel) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// SetFormat sets the record format, see logFormats.
+func (l *Logger) SetFormat(format string) error {
+	if !containsString(logFormats, format) {
+		return fmt.Errorf("unknown log format %q, expected one of: %s", format, strings.Join(logFormats, ", "))
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.format = format
+	return nil
+}
+
+// Debugf logs a debug message.
+func (l *Logger) Debugf(format string, v ...interface{}) { l.logf(LevelDebug, format, v...) }
+
+// Infof logs an informational message.
+func (l *Logger) Infof(format string, v ...interface{}) { l.logf(LevelInfo, format, v...) }
+
+// Warnf logs a warning.
+func (l *Logger) Warnf(format string, v ...interface{}) { l.logf(LevelWarn, format, v...) }
+
+// Errorf logs an error.
+func (l *Logger) Errorf(format string, v ...interface{}) { l.logf(LevelError, format, v...) }
+
+func (l *Logger) logf(level LogLevel, format string, v ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+	l.write(level, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) write(level LogLevel, msg string) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+
+	w := l.out.w
+	switch l.out.format {
+	case LogFormatJSON:
+		if w == nil {
+			w = os.Stderr
+		}
+		fmt.Fprintln(w, l.json(level, msg))
+	case LogFormatLogfmt:
+		if w == nil {
+			w = os.Stderr
+		}
+		fmt.Fprintln(w, l.logfmt(level, msg))
+	default:
+		line := l.text(level, msg)
+		if w == nil {
+			_ = log.Output(4, line)
+		} else {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func (l *Logger) text(level LogLevel, msg string) string {
+	line := fmt.Sprintf("[%s][%s] %s", level.letter(), l.component, msg)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		line += " " + fmt.Sprint(l.fields[i]) + "=" + logfmtValue(l.fields[i+1])
+	}
+	return line
+}
+
+func (l *Logger) json(level LogLevel, msg string) string {
+	pairs := []string{
+		jsonPair("time", time.Now().UTC().Format(time.RFC3339Nano)),
+		jsonPair("level", level.String()),
+		jsonPair("component", l.component),
+		jsonPair("msg", msg),
+	}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		pairs = append(pairs, jsonPair(fmt.Sprint(l.fields[i]), logValue(l.fields[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (l *Logger) logfmt(level LogLevel, msg string) string {
+	pairs := []string{
+		"time=" + time.Now().UTC().Format(time.RFC3339Nano),
+		"level=" + level.String(),
+		"component=" + logfmtValue(l.component),
+		"msg=" + logfmtValue(msg),
+	}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		pairs = append(pairs, fmt.Sprint(l.fields[i])+"="+logfmtValue(l.fields[i+1]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// logValue converts a field value to a JSON encodable one, keeping numbers and
+// booleans as they are.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, int, int64, uint64, float64, string:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+func jsonPair(key string, v interface{}) string {
+	k, _ := json.Marshal(key)
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(k) + ":" + string(b)
+}
+
+// logfmtValue formats a field value, quoting it if empty or if it contains
+// spaces, quotes, or equal signs.
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(logValue(v))
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// sourceFields returns the log fields identifying a build source.
+func sourceFields(s *Source) []interface{} {
+	return []interface{}{"repo", s.Owner + "/" + s.Repo, "sha", s.Rev}
+}
+
+// buildLog returns l with the fields identifying build b.
+func buildLog(l *Logger, b *Build) *Logger {
+	return l.With("build_id", b.ID).With(sourceFields(b.Source)...)
+}
@@ -0,0 +1,43 @@
+package seaeye
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf).Named("web").With("build_id", 7, "repo", "scraperwiki/seaeye")
+
+	l.Debugf("hidden")
+	l.Infof("Enqueued job: build %d", 7)
+	assert.Equal(t, "[I][web] Enqueued job: build 7 build_id=7 repo=scraperwiki/seaeye\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, l.SetFormat(LogFormatJSON))
+	l.With("err", errors.New("boom")).Errorf("Failed")
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "error", record["level"])
+	assert.Equal(t, "web", record["component"])
+	assert.Equal(t, "Failed", record["msg"])
+	assert.Equal(t, float64(7), record["build_id"])
+	assert.Equal(t, "boom", record["err"])
+
+	buf.Reset()
+	assert.NoError(t, l.SetFormat(LogFormatLogfmt))
+	l.SetLevel(LevelDebug)
+	l.Debugf("Event: %s", "push")
+	line := buf.String()
+	assert.True(t, strings.HasPrefix(line, "time="), line)
+	assert.Contains(t, line, ` level=debug component=web msg="Event: push" build_id=7 repo=scraperwiki/seaeye`+"\n")
+
+	assert.Error(t, l.SetFormat("xml"))
+	_, err := ParseLogLevel("verbose")
+	assert.Error(t, err)
+}
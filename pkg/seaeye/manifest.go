@@ -6,6 +6,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -13,50 +16,399 @@ import (
 // ErrManifestNotFound defines that no manifest file could be found.
 var ErrManifestNotFound = errors.New("no manifest file found")
 
-// Manifest defines the structure of a .seaeye.yml manifest file.
+// Conditions under which a command is run, based on the result of the relevant
+// stages run so far.
+const (
+	WhenAlways    = "always"
+	WhenOnSuccess = "on_success"
+	WhenOnFailure = "on_failure"
+)
+
+// DefaultShell defines the shell running script commands, failing on the first
+// failing command.
+var DefaultShell = []string{"sh", "-e", "-c"}
+
+var envVarNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Manifest defines the structure of a .seaeye.yml manifest file. Version 1
+// manifests define the fixed stages Pre, Test, and Post, while version 2
+// manifests define a list of named Stages.
 type Manifest struct {
-	Environment []string   `yaml:",omitempty"`
-	Pre         [][]string `yaml:",omitempty,flow"`
-	Test        [][]string `yaml:",omitempty,flow"`
-	Post        [][]string `yaml:",omitempty,flow"`
+	Version     int               `yaml:",omitempty"`
+	Environment []string          `yaml:",omitempty"`
+	Secrets     map[string]string `yaml:",omitempty"`
+	Shell       []string          `yaml:",omitempty,flow"`
+	Stages      []*Stage          `yaml:",omitempty"`
+	Pre         []Command         `yaml:",omitempty,flow"`
+	Test        []Command         `yaml:",omitempty,flow"`
+	Post        []Command         `yaml:",omitempty,flow"`
+	Cleanup     []Command         `yaml:",omitempty,flow"`
+	Matrix      *Matrix           `yaml:",omitempty"`
 }
 
-// Validate checks the validity of a manifest.
-func (m *Manifest) Validate() error {
-	// TODO(uwe): Eventual check manifest first
+// Command defines a single manifest command. It is either written as argv
+// list, e.g. `["make", "it"]`, as shell script, e.g. `make it | tee out.txt`,
+// or as mapping with additional options, e.g. `{run: "make report", post:
+// on_failure}`, where `when` is accepted in place of `post`. A mapping with a `parallel` list instead defines a block of
+// commands run concurrently, e.g. `{parallel: ["make lint", "make unit"],
+// fail_fast: true}`.
+type Command struct {
+	Args     []string
+	Script   string
+	When     string
+	Parallel []Command
+	FailFast bool
+
+	whenKey string // manifest key the condition was given with
+}
+
+// commandLine is the command part of a Command, either a script or argv list.
+type commandLine struct {
+	Args   []string
+	Script string
+}
+
+func (l *commandLine) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&l.Script); err == nil {
+		return nil
+	}
+	return unmarshal(&l.Args)
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler to accept all command notations.
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var line commandLine
+	if err := unmarshal(&line); err == nil {
+		c.Args = line.Args
+		c.Script = line.Script
+		return nil
+	}
+
+	var v struct {
+		Run      commandLine `yaml:"run"`
+		Post     string      `yaml:"post"`
+		When     string      `yaml:"when"`
+		Parallel []Command   `yaml:"parallel"`
+		FailFast bool        `yaml:"fail_fast"`
+	}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	c.Args = v.Run.Args
+	c.Script = v.Run.Script
+	c.When = v.When
+	if v.Post != "" {
+		c.When = v.Post
+		c.whenKey = "post"
+	}
+	c.Parallel = v.Parallel
+	c.FailFast = v.FailFast
 	return nil
 }
 
+// Argv returns the argument list to execute, running scripts with the given
+// shell.
+func (c *Command) Argv(shell []string) []string {
+	if c.Script == "" {
+		return c.Args
+	}
+	argv := append([]string{}, shell...)
+	return append(argv, c.Script)
+}
+
+// Expand returns the command with the variable references in its arguments
+// that mapping knows replaced. Scripts are left to the shell, which gets the
+// same variables from the environment, so values never become shell code.
+func (c Command) Expand(mapping func(string) (string, bool)) Command {
+	if c.Args == nil {
+		return c
+	}
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = interpolate(arg, mapping)
+	}
+	c.Args = args
+	return c
+}
+
+// RunsOn decides if a command is to be run given the result of the relevant
+// stages run so far. Commands without condition always run.
+func (c *Command) RunsOn(result string) bool {
+	switch c.When {
+	case WhenOnSuccess:
+		return result == "success"
+	case WhenOnFailure:
+		return result != "success"
+	default:
+		return true
+	}
+}
+
+// ShellArgv returns the shell, with its arguments, used to run scripts.
+func (m *Manifest) ShellArgv() []string {
+	if len(m.Shell) == 0 {
+		return DefaultShell
+	}
+	return m.Shell
+}
+
+// Validate checks the validity of a manifest. The returned error, if any, is of
+// type ManifestErrors.
+func (m *Manifest) Validate() error {
+	var errs ManifestErrors
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, &ManifestError{Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	switch m.Version {
+	case 0, 1:
+		if len(m.Stages) > 0 {
+			add("stages", "requires version 2")
+		}
+	case 2:
+		if len(m.Pre) > 0 {
+			add("pre", "not supported by version 2, use stages")
+		}
+		if len(m.Test) > 0 {
+			add("test", "not supported by version 2, use stages")
+		}
+		if len(m.Post) > 0 {
+			add("post", "not supported by version 2, use stages")
+		}
+	default:
+		add("version", "unsupported version %d (expected 1 or 2)", m.Version)
+	}
+
+	// Environment values may refer to build variables and preceding
+	// environment variables, argv commands to any variable, see
+	// commandVariables. Scripts are left to the shell.
+	defined := map[string]bool{}
+	for _, names := range [][]string{BuildVariables, hostVariables} {
+		for _, name := range names {
+			defined[name] = true
+		}
+	}
+	for i, e := range m.Environment {
+		path := fmt.Sprintf("environment[%d]", i)
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			add(path, "expected KEY=VALUE, got %q", e)
+			continue
+		}
+		if !envVarNamePattern.MatchString(parts[0]) {
+			add(path, "invalid environment variable name %q", parts[0])
+		}
+		if err := checkVariables(parts[1], defined); err != nil {
+			add(path, "%v", err)
+		}
+		defined[parts[0]] = true
+	}
+
+	for name, secret := range m.Secrets {
+		path := "secrets." + name
+		if !envVarNamePattern.MatchString(name) {
+			add(path, "invalid environment variable name %q", name)
+		}
+		if _, err := decodeSecret(secret); err != nil {
+			add(path, "%v, expected output of seaeye encrypt", err)
+		}
+	}
+
+	for i, arg := range m.Shell {
+		if arg == "" {
+			add(fmt.Sprintf("shell[%d]", i), "empty argument")
+		}
+	}
+
+	if m.Matrix != nil {
+		for k, vs := range m.Matrix.Env {
+			path := "matrix.env." + k
+			if !envVarNamePattern.MatchString(k) {
+				add(path, "invalid environment variable name %q", k)
+			}
+			if len(vs) == 0 {
+				add(path, "no values")
+			}
+		}
+		for _, name := range []string{"exclude", "include"} {
+			entries := m.Matrix.Exclude
+			if name == "include" {
+				entries = m.Matrix.Include
+			}
+			for i, e := range entries {
+				path := fmt.Sprintf("matrix.%s[%d]", name, i)
+				if len(e) == 0 {
+					add(path, "empty entry")
+				}
+				for k := range e {
+					if !envVarNamePattern.MatchString(k) {
+						add(path+"."+k, "invalid environment variable name %q", k)
+					}
+				}
+			}
+		}
+	}
+
+	type commandList struct {
+		path     string
+		commands []Command
+	}
+	lists := []commandList{{"pre", m.Pre}, {"test", m.Test}, {"post", m.Post}, {"cleanup", m.Cleanup}}
+
+	names := map[string]bool{}
+	relevant := false
+	for i, s := range m.Stages {
+		relevant = relevant || s.IsRelevant()
+		path := fmt.Sprintf("stages[%d]", i)
+		if s.Name == "" {
+			add(path, "missing name")
+		} else if names[s.Name] {
+			add(path+".name", "duplicate stage %q", s.Name)
+		}
+		names[s.Name] = true
+		if len(s.Commands) == 0 {
+			add(path, "no commands")
+		}
+		lists = append(lists, commandList{path + ".commands", s.Commands})
+	}
+	for i, s := range m.Stages {
+		for _, n := range s.Needs {
+			if !names[n] {
+				add(fmt.Sprintf("stages[%d].needs", i), "unknown stage %q", n)
+			}
+		}
+	}
+	if m.Version == 2 && !relevant {
+		add("stages", "no relevant stage, every stage is relevant: false or allow_failure")
+	}
+	if len(errs) == 0 && m.Version == 2 {
+		if _, err := sortStages(m.Stages); err != nil {
+			add("stages", "%v", err)
+		}
+	}
+
+	vars := m.commandVariables()
+	for _, l := range lists {
+		for i, c := range l.commands {
+			errs = append(errs, validateCommand(fmt.Sprintf("%s[%d]", l.path, i), c, vars, false)...)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validateCommand(path string, c Command, defined map[string]bool, inParallel bool) ManifestErrors {
+	var errs ManifestErrors
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, &ManifestError{Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if len(c.Parallel) > 0 {
+		if len(c.Args) > 0 || c.Script != "" {
+			add(path, "run and parallel are mutually exclusive")
+		}
+		for i, pc := range c.Parallel {
+			errs = append(errs, validateCommand(fmt.Sprintf("%s.parallel[%d]", path, i), pc, defined, true)...)
+		}
+	} else {
+		if c.Script == "" && (len(c.Args) == 0 || c.Args[0] == "") {
+			add(path, "empty command")
+		}
+		if c.FailFast {
+			add(path+".fail_fast", "requires parallel")
+		}
+		for _, arg := range c.Args {
+			if err := checkVariables(arg, defined); err != nil {
+				add(path, "%v", err)
+				break
+			}
+		}
+	}
+
+	whenPath := path + ".when"
+	if c.whenKey != "" {
+		whenPath = path + "." + c.whenKey
+	}
+	switch c.When {
+	case "", WhenAlways, WhenOnSuccess, WhenOnFailure:
+		if c.When != "" && inParallel {
+			add(whenPath, "not supported within parallel")
+		}
+	default:
+		add(whenPath, "invalid condition %q (expected %s, %s, or %s)",
+			c.When, WhenAlways, WhenOnSuccess, WhenOnFailure)
+	}
+
+	return errs
+}
+
+// ParseManifest parses and strictly validates a manifest. Any error returned is
+// of type ManifestErrors, locating every problem found by line and column.
+func ParseManifest(b []byte) (*Manifest, error) {
+	var raw yaml.MapSlice
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, yamlErrors(err)
+	}
+
+	scanner := newManifestScanner(b)
+	scanner.manifest(raw)
+	errs := scanner.errs
+
+	m := &Manifest{}
+	if err := yaml.Unmarshal(b, m); err != nil {
+		errs = append(errs, yamlErrors(err)...)
+	} else if err := m.Validate(); err != nil {
+		errs = append(errs, err.(ManifestErrors)...)
+	}
+
+	if len(errs) > 0 {
+		scanner.locate(errs)
+		sort.Stable(errs)
+		return nil, errs
+	}
+	return m, nil
+}
+
 // FindManifest looks for a .seaeye.yml file in a given directory and tries to
 // parse this file as manifest.
 func FindManifest(wd string) (*Manifest, error) {
-	var b []byte
-	var err error
+	manifestPath, err := FindManifestFile(wd)
+	if err != nil {
+		return nil, err
+	}
+	return ReadManifest(manifestPath)
+}
 
+// FindManifestFile looks for a .seaeye.yml file in a given directory and
+// returns its path.
+func FindManifestFile(wd string) (string, error) {
 	manifestFilenames := []string{".seaeye.yml", ".seaeye.yaml"}
 	for _, manifestFilename := range manifestFilenames {
 		manifestPath := path.Join(wd, manifestFilename)
-		b, err = ioutil.ReadFile(manifestPath)
+		fi, err := os.Stat(manifestPath)
 		if os.IsNotExist(err) {
 			continue
 		} else if err != nil {
-			return nil, fmt.Errorf("failed to read manifest file %s: %v", manifestPath, err)
-		} else {
+			return "", fmt.Errorf("failed to read manifest file %s: %v", manifestPath, err)
+		} else if fi.Size() == 0 {
 			break
 		}
+		return manifestPath, nil
 	}
-	if err != nil || len(b) == 0 {
-		return nil, ErrManifestNotFound
-	}
+	return "", ErrManifestNotFound
+}
 
-	m := &Manifest{}
-	if err := yaml.Unmarshal(b, m); err != nil {
-		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+// ReadManifest reads and parses a manifest file.
+func ReadManifest(manifestPath string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest file %s: %v", manifestPath, err)
 	}
-
-	if err := m.Validate(); err != nil {
-		return nil, fmt.Errorf("failed to validate manifest: %v", err)
+	if len(b) == 0 {
+		return nil, ErrManifestNotFound
 	}
-
-	return m, nil
+	return ParseManifest(b)
 }
@@ -0,0 +1,398 @@
+package seaeye
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ManifestError describes a single problem of a manifest. Line and Column are
+// 1-based and zero if unknown.
+type ManifestError struct {
+	Path   string // e.g. stages[1].needs
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ManifestError) Error() string {
+	var prefix string
+	if e.Line > 0 {
+		prefix = fmt.Sprintf("line %d: ", e.Line)
+		if e.Column > 0 {
+			prefix = fmt.Sprintf("line %d, column %d: ", e.Line, e.Column)
+		}
+	}
+	if e.Path != "" {
+		prefix += e.Path + ": "
+	}
+	return prefix + e.Msg
+}
+
+// ManifestErrors holds all problems found in a manifest.
+type ManifestErrors []*ManifestError
+
+func (es ManifestErrors) Error() string {
+	var msgs []string
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (es ManifestErrors) Len() int      { return len(es) }
+func (es ManifestErrors) Swap(i, j int) { es[i], es[j] = es[j], es[i] }
+func (es ManifestErrors) Less(i, j int) bool {
+	if es[i].Line != es[j].Line {
+		return es[i].Line < es[j].Line
+	}
+	return es[i].Column < es[j].Column
+}
+
+var yamlErrorPattern = regexp.MustCompile(`line (\d+): (.*)`)
+
+// yamlErrors converts syntax and type errors of the yaml package into manifest
+// errors.
+func yamlErrors(err error) ManifestErrors {
+	var msgs []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	var errs ManifestErrors
+	for _, msg := range msgs {
+		e := &ManifestError{Msg: msg}
+		if m := yamlErrorPattern.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Msg = m[2]
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+var (
+	manifestKeys = []string{"version", "environment", "secrets", "shell", "stages", "pre", "test", "post", "cleanup", "matrix"}
+	stageKeys    = []string{"name", "needs", "relevant", "allow_failure", "commands"}
+	commandKeys  = []string{"run", "post", "when", "parallel", "fail_fast"}
+	matrixKeys   = []string{"env", "exclude", "include"}
+)
+
+// manifestScanner walks the generic structure of a manifest in document order,
+// rejecting unknown keys and recording the position of every path. As the yaml
+// package doesn't expose positions, they are found by searching the source
+// from the position of the previously visited node onwards.
+type manifestScanner struct {
+	src       []byte
+	offset    int
+	positions map[string]int
+	errs      ManifestErrors
+}
+
+func newManifestScanner(src []byte) *manifestScanner {
+	return &manifestScanner{src: src, positions: map[string]int{}}
+}
+
+// position returns the line and column of a path, falling back to its closest
+// known parent.
+func (s *manifestScanner) position(path string) (line, col int) {
+	for path != "" {
+		if offset, ok := s.positions[path]; ok {
+			return s.lineColumn(offset)
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0, 0
+}
+
+func (s *manifestScanner) lineColumn(offset int) (line, col int) {
+	before := s.src[:offset]
+	line = bytes.Count(before, []byte{'\n'}) + 1
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	col = utf8.RuneCount(before[lineStart:]) + 1
+	return line, col
+}
+
+// findKey searches for a mapping key from the current offset onwards and
+// returns its offset, or -1 if not found.
+func (s *manifestScanner) findKey(key string) int {
+	for from := s.offset; from < len(s.src); {
+		i := bytes.Index(s.src[from:], []byte(key))
+		if i < 0 {
+			return -1
+		}
+		i += from
+		from = i + len(key)
+
+		if i > 0 && !strings.ContainsRune(" \t\n-{,\"'", rune(s.src[i-1])) {
+			continue
+		}
+		rest := bytes.TrimLeft(s.src[from:], " \t\"'")
+		if len(rest) > 0 && rest[0] == ':' {
+			s.offset = from
+			return i
+		}
+	}
+	return -1
+}
+
+// findScalar searches for the first line of a scalar value from the current
+// offset onwards and returns its offset, or -1 if not found.
+func (s *manifestScanner) findScalar(v interface{}) int {
+	text := strings.SplitN(fmt.Sprint(v), "\n", 2)[0]
+	if text == "" {
+		return -1
+	}
+	i := bytes.Index(s.src[s.offset:], []byte(text))
+	if i < 0 {
+		return -1
+	}
+	i += s.offset
+	s.offset = i + len(text)
+	return i
+}
+
+// record sets the position of a path unless already known, which keeps keys
+// located at the key instead of at their value.
+func (s *manifestScanner) record(path string, offset int) {
+	if _, ok := s.positions[path]; !ok && offset >= 0 {
+		s.positions[path] = offset
+	}
+}
+
+// findItem searches for the next block sequence entry, i.e. `- `, directly
+// following the current offset and returns the offset of its content, or -1
+// if not found.
+func (s *manifestScanner) findItem() int {
+	from := s.offset
+	for from < len(s.src) {
+		end := bytes.IndexByte(s.src[from:], '\n')
+		if end < 0 {
+			end = len(s.src)
+		} else {
+			end += from
+		}
+		line := bytes.TrimLeft(s.src[from:end], " \t")
+		switch {
+		case bytes.HasPrefix(line, []byte("- ")) || bytes.Equal(line, []byte("-")):
+			i := end - len(line) + 1
+			for i < end && (s.src[i] == ' ' || s.src[i] == '\t') {
+				i++
+			}
+			s.offset = i
+			return i
+		case len(line) == 0, line[0] == '#', line[0] == ':':
+			from = end + 1
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+func (s *manifestScanner) unknownKey(path, key string, known []string) {
+	msg := fmt.Sprintf("unknown key %q", key)
+	if k := closestKey(key, known); k != "" {
+		msg += fmt.Sprintf(", did you mean %q?", k)
+	} else {
+		msg += fmt.Sprintf(", expected one of: %s", strings.Join(known, ", "))
+	}
+	s.errs = append(s.errs, &ManifestError{Path: path, Msg: msg})
+}
+
+// mapping walks a mapping node, calling visit for every known key.
+func (s *manifestScanner) mapping(path string, v interface{}, known []string, visit func(path, key string, v interface{})) int {
+	ms, ok := v.(yaml.MapSlice)
+	if !ok {
+		return s.value(path, v)
+	}
+
+	start := -1
+	for _, item := range ms {
+		key := fmt.Sprint(item.Key)
+		p := key
+		if path != "" {
+			p = path + "." + key
+		}
+		offset := s.findKey(key)
+		s.record(p, offset)
+		if start < 0 {
+			start = offset
+		}
+
+		if !containsString(known, key) {
+			s.unknownKey(p, key, known)
+			s.value(p, item.Value)
+			continue
+		}
+		visit(p, key, item.Value)
+	}
+	return start
+}
+
+// value walks any node without checking its keys.
+func (s *manifestScanner) value(path string, v interface{}) int {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		start := -1
+		for _, item := range v {
+			p := fmt.Sprintf("%s.%v", path, item.Key)
+			offset := s.findKey(fmt.Sprint(item.Key))
+			s.record(p, offset)
+			s.value(p, item.Value)
+			if start < 0 {
+				start = offset
+			}
+		}
+		return start
+	case []interface{}:
+		start := -1
+		for i, item := range v {
+			offset := s.value(fmt.Sprintf("%s[%d]", path, i), item)
+			if start < 0 {
+				start = offset
+			}
+		}
+		return start
+	case nil:
+		return -1
+	default:
+		offset := s.findScalar(v)
+		s.record(path, offset)
+		return offset
+	}
+}
+
+func (s *manifestScanner) manifest(v interface{}) {
+	s.mapping("", v, manifestKeys, func(path, key string, v interface{}) {
+		switch key {
+		case "pre", "test", "post", "cleanup":
+			s.commands(path, v)
+		case "stages":
+			s.items(path, v, s.stage)
+		case "matrix":
+			s.mapping(path, v, matrixKeys, func(path, key string, v interface{}) {
+				s.value(path, v)
+			})
+		default:
+			s.value(path, v)
+		}
+	})
+}
+
+func (s *manifestScanner) stage(path string, v interface{}) int {
+	return s.mapping(path, v, stageKeys, func(path, key string, v interface{}) {
+		if key == "commands" {
+			s.commands(path, v)
+		} else {
+			s.value(path, v)
+		}
+	})
+}
+
+func (s *manifestScanner) commands(path string, v interface{}) {
+	s.items(path, v, s.command)
+}
+
+func (s *manifestScanner) command(path string, v interface{}) int {
+	if _, ok := v.(yaml.MapSlice); !ok {
+		return s.value(path, v)
+	}
+	var post bool
+	return s.mapping(path, v, commandKeys, func(path, key string, v interface{}) {
+		switch key {
+		case "parallel":
+			s.commands(path, v)
+		case "post", "when":
+			if post {
+				s.errs = append(s.errs, &ManifestError{Path: path, Msg: "post and when are mutually exclusive"})
+			}
+			post = true
+			s.value(path, v)
+		default:
+			s.value(path, v)
+		}
+	})
+}
+
+// items walks a sequence node, recording the position of every item.
+func (s *manifestScanner) items(path string, v interface{}, visit func(path string, v interface{}) int) {
+	seq, ok := v.([]interface{})
+	if !ok {
+		s.value(path, v)
+		return
+	}
+	for i, item := range seq {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		s.record(p, s.findItem())
+		s.record(p, visit(p, item))
+	}
+}
+
+// locate sets the position of errors from their path.
+func (s *manifestScanner) locate(errs ManifestErrors) {
+	for _, e := range errs {
+		if e.Line == 0 {
+			e.Line, e.Column = s.position(e.Path)
+		}
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// closestKey returns the known key most similar to key, if any is similar
+// enough to be a likely typo.
+func closestKey(key string, known []string) string {
+	best, bestDist := "", 3
+	for _, k := range known {
+		if d := levenshtein(key, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,96 @@
+package seaeye
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseManifest(t *testing.T) {
+	m, err := ParseManifest([]byte(`
+environment:
+  - FOO=BAR
+test:
+  - ["make", "it"]
+  - make it | tee out.txt
+  - run: make report
+    when: on_failure
+  - parallel:
+      - make lint
+      - ["make", "unit"]
+    fail_fast: true
+post:
+  - {run: make notify, post: on_success}
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"make", "it"}, m.Test[0].Args)
+	assert.Equal(t, "make it | tee out.txt", m.Test[1].Script)
+	assert.Equal(t, WhenOnFailure, m.Test[2].When)
+	assert.Equal(t, []string{"sh", "-e", "-c", "make report"}, m.Test[2].Argv(m.ShellArgv()))
+	assert.Len(t, m.Test[3].Parallel, 2)
+	assert.True(t, m.Test[3].FailFast)
+	assert.Equal(t, WhenOnSuccess, m.Post[0].When)
+}
+
+func TestParseManifestPostErrors(t *testing.T) {
+	_, err := ParseManifest([]byte(`post:
+  - {run: make it, post: sometimes}
+  - {run: make it, post: always, when: always}
+`))
+	assert.IsType(t, ManifestErrors{}, err)
+	errs := err.(ManifestErrors)
+	if assert.Len(t, errs, 2) {
+		assert.Equal(t, `line 2, column 20: post[0].post: invalid condition "sometimes" (expected always, on_success, or on_failure)`, errs[0].Error())
+		assert.Equal(t, `line 3, column 34: post[1].when: post and when are mutually exclusive`, errs[1].Error())
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	_, err := ParseManifest([]byte(`environment:
+  - FOO
+tests:
+  - ["make", "it"]
+test:
+  - []
+  - {run: make it, when: sometimes, timeout: 1}
+`))
+	assert.IsType(t, ManifestErrors{}, err)
+	errs := err.(ManifestErrors)
+	if assert.Len(t, errs, 5) {
+		assert.Equal(t, `line 2, column 5: environment[0]: expected KEY=VALUE, got "FOO"`, errs[0].Error())
+		assert.Equal(t, `line 3, column 1: tests: unknown key "tests", did you mean "test"?`, errs[1].Error())
+		assert.Equal(t, `line 6, column 5: test[0]: empty command`, errs[2].Error())
+		assert.Equal(t, `line 7, column 20: test[1].when: invalid condition "sometimes" (expected always, on_success, or on_failure)`, errs[3].Error())
+		assert.Equal(t, 7, errs[4].Line)
+		assert.Contains(t, errs[4].Msg, `unknown key "timeout"`)
+	}
+}
+
+func TestParseManifestTypeErrors(t *testing.T) {
+	_, err := ParseManifest([]byte("version: 2\nstages:\n  - name: [a]\n"))
+	if assert.Error(t, err) {
+		errs := err.(ManifestErrors)
+		assert.Equal(t, 3, errs[0].Line)
+		assert.Contains(t, errs[0].Msg, "cannot unmarshal")
+	}
+}
+
+func TestParseManifestVariables(t *testing.T) {
+	_, err := ParseManifest([]byte(`environment:
+  - GOPATH=${WORKSPACE}/go
+  - PATH=${GOPATH}/bin:${PATH}
+  - BIN=${BINDIR}/app
+test:
+  - ["echo", "${SEAEYE_BRANCH}", "${GOPATH}"]
+  - ["echo", "${TARGET}", "$${LITERAL}", "$HOME"]
+  - ["echo", "${1}"]
+  - echo ${TARGET} ${1} ${FOO:-default}
+`))
+	assert.IsType(t, ManifestErrors{}, err)
+	errs := err.(ManifestErrors)
+	if assert.Len(t, errs, 3) {
+		assert.Equal(t, `line 4, column 5: environment[2]: undefined variable "BINDIR"`, errs[0].Error())
+		assert.Equal(t, `line 7, column 7: test[1]: undefined variable "TARGET"`, errs[1].Error())
+		assert.Contains(t, errs[2].Error(), `test[2]: invalid variable reference "${1}"`)
+	}
+}
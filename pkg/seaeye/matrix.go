@@ -0,0 +1,117 @@
+package seaeye
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Matrix defines environment variable axes expanding a build into multiple
+// sub-builds, one per combination of values. Example:
+//
+//	matrix:
+//	  env:
+//	    GO: ["1.6", "1.7"]
+//	    PYTHON: ["2.7", "3.5"]
+//	  exclude:
+//	    - {GO: "1.6", PYTHON: "3.5"}
+//	  include:
+//	    - {GO: "tip", PYTHON: "3.5"}
+type Matrix struct {
+	Env     map[string][]string `yaml:",omitempty"`
+	Exclude []map[string]string `yaml:",omitempty"`
+	Include []map[string]string `yaml:",omitempty"`
+}
+
+// MatrixCell specifies a single sub-build of a matrix.
+type MatrixCell struct {
+	// Name identifies the cell, e.g. `go-1.6/python-2.7`.
+	Name string
+	// Env holds the cell's environment variables, e.g. `GO=1.6`.
+	Env []string
+}
+
+// Expand returns all cells of the matrix: the cartesian product of all axes,
+// without the cells matching any exclude entry, plus all include entries.
+func (m *Matrix) Expand() []*MatrixCell {
+	if m == nil {
+		return nil
+	}
+
+	var keys []string
+	for k := range m.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var combinations []map[string]string
+	if len(keys) > 0 {
+		combinations = []map[string]string{{}}
+	}
+	for _, k := range keys {
+		var next []map[string]string
+		for _, c := range combinations {
+			for _, v := range m.Env[k] {
+				n := map[string]string{k: v}
+				for ck, cv := range c {
+					n[ck] = cv
+				}
+				next = append(next, n)
+			}
+		}
+		combinations = next
+	}
+
+	var cells []*MatrixCell
+	seen := map[string]bool{}
+	add := func(c map[string]string) {
+		cell := newMatrixCell(c)
+		if !seen[cell.Name] {
+			seen[cell.Name] = true
+			cells = append(cells, cell)
+		}
+	}
+	for _, c := range combinations {
+		excluded := false
+		for _, e := range m.Exclude {
+			if matchesMatrixEntry(c, e) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			add(c)
+		}
+	}
+	for _, c := range m.Include {
+		add(c)
+	}
+
+	return cells
+}
+
+func newMatrixCell(vars map[string]string) *MatrixCell {
+	var keys []string
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	cell := &MatrixCell{}
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s-%s", strings.ToLower(k), vars[k]))
+		cell.Env = append(cell.Env, fmt.Sprintf("%s=%s", k, vars[k]))
+	}
+	cell.Name = strings.Join(parts, "/")
+	return cell
+}
+
+func matchesMatrixEntry(vars, entry map[string]string) bool {
+	for k, v := range entry {
+		if vars[k] != v {
+			return false
+		}
+	}
+	return len(entry) > 0
+}
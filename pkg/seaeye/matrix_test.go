@@ -0,0 +1,36 @@
+package seaeye
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatrixExpand(t *testing.T) {
+	m := &Matrix{
+		Env: map[string][]string{
+			"PYTHON": []string{"2.7", "3.5"},
+			"GO":     []string{"1.6", "1.7"},
+		},
+		Exclude: []map[string]string{{"GO": "1.6", "PYTHON": "3.5"}},
+		Include: []map[string]string{{"GO": "tip", "PYTHON": "3.5"}},
+	}
+
+	var names []string
+	for _, c := range m.Expand() {
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, []string{
+		"go-1.6/python-2.7",
+		"go-1.7/python-2.7",
+		"go-1.7/python-3.5",
+		"go-tip/python-3.5",
+	}, names)
+	assert.Equal(t, []string{"GO=tip", "PYTHON=3.5"}, m.Expand()[3].Env)
+}
+
+func TestMatrixExpandEmpty(t *testing.T) {
+	var m *Matrix
+	assert.Empty(t, m.Expand())
+	assert.Empty(t, (&Matrix{}).Expand())
+}
@@ -0,0 +1,232 @@
+package seaeye
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Histogram buckets in seconds.
+var (
+	buildDurationBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+	fetchDurationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	httpDurationBuckets  = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// Metrics collected across all builds and requests.
+var (
+	metrics = &metricRegistry{}
+
+	metricBuilds = metrics.counter("seaeye_builds_total",
+		"Number of finished builds.", "repo", "state")
+	metricBuildDuration = metrics.histogram("seaeye_build_duration_seconds",
+		"Duration of finished builds.", buildDurationBuckets, "repo", "state")
+	metricStageDuration = metrics.histogram("seaeye_stage_duration_seconds",
+		"Duration of build stages.", buildDurationBuckets, "repo", "stage")
+	metricFetchDuration = metrics.histogram("seaeye_fetch_duration_seconds",
+		"Duration of fetching sources.", fetchDurationBuckets, "repo")
+	metricFetchFailures = metrics.counter("seaeye_fetch_failures_total",
+		"Number of failed fetches.", "repo")
+	metricNotifierErrors = metrics.counter("seaeye_notifier_errors_total",
+		"Number of failed notifications.", "notifier")
+	metricGithubRateLimitRemaining = metrics.gauge("seaeye_github_rate_limit_remaining",
+		"Github API requests remaining in the current rate limit window.")
+	metricJanitorRemoved = metrics.counter("seaeye_janitor_removed_total",
+		"Number of build log directories and workspaces removed.", "kind")
+	metricJanitorRemovedBytes = metrics.counter("seaeye_janitor_removed_bytes_total",
+		"Size of build log directories and workspaces removed.", "kind")
+	metricHTTPRequests = metrics.counter("seaeye_http_requests_total",
+		"Number of HTTP requests.", "route", "method", "code")
+	metricHTTPDuration = metrics.histogram("seaeye_http_request_duration_seconds",
+		"Duration of HTTP requests.", httpDurationBuckets, "route", "method")
+)
+
+// metricRegistry holds metrics to be written in the Prometheus text exposition
+// format.
+type metricRegistry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// metric holds the series of a counter, gauge, or histogram by their label
+// values.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64  // counter, gauge, or histogram sum
+	count   uint64   // histogram only
+	buckets []uint64 // histogram only, not cumulative
+}
+
+func (r *metricRegistry) add(m *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m.series = map[string]*metricSeries{}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *metricRegistry) counter(name, help string, labels ...string) *metric {
+	return r.add(&metric{name: name, help: help, kind: "counter", labels: labels})
+}
+
+func (r *metricRegistry) gauge(name, help string, labels ...string) *metric {
+	return r.add(&metric{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func (r *metricRegistry) histogram(name, help string, buckets []float64, labels ...string) *metric {
+	return r.add(&metric{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})
+}
+
+// with returns the series of the label values, given in the order of the
+// metric's labels. Requires m.mu to be held.
+func (m *metric) with(values []string) *metricSeries {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string{}, values...)}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Inc increments a counter.
+func (m *metric) Inc(values ...string) {
+	m.Add(1, values...)
+}
+
+// Add adds v to a counter or gauge.
+func (m *metric) Add(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(values).value += v
+}
+
+// Set sets a gauge.
+func (m *metric) Set(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(values).value = v
+}
+
+// Observe records a histogram observation.
+func (m *metric) Observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.with(values)
+	s.value += v
+	s.count++
+	for i, le := range m.buckets {
+		if v <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+// WriteTo writes all metrics, with series sorted by label values.
+func (r *metricRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	all := append([]*metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	var n int64
+	for _, m := range all {
+		c, err := io.WriteString(w, m.text())
+		n += int64(c)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (m *metric) text() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines := []string{
+		fmt.Sprintf("# HELP %s %s", m.name, escapeMetricHelp(m.help)),
+		fmt.Sprintf("# TYPE %s %s", m.name, m.kind),
+	}
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string{}, m.labels...), "le")
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			lines = append(lines, m.name+metricLabels(m.labels, s.labels)+" "+formatMetricValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += s.buckets[i]
+			labels := metricLabels(bucketLabels, append(s.labels[:len(s.labels):len(s.labels)], formatMetricValue(le)))
+			lines = append(lines, m.name+"_bucket"+labels+" "+strconv.FormatUint(cumulative, 10))
+		}
+		labels := metricLabels(bucketLabels, append(s.labels[:len(s.labels):len(s.labels)], "+Inf"))
+		lines = append(lines,
+			m.name+"_bucket"+labels+" "+strconv.FormatUint(s.count, 10),
+			m.name+"_sum"+metricLabels(m.labels, s.labels)+" "+formatMetricValue(s.value),
+			m.name+"_count"+metricLabels(m.labels, s.labels)+" "+strconv.FormatUint(s.count, 10),
+		)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// writeMetric writes a single, unlabeled metric computed on demand.
+func writeMetric(w io.Writer, name, kind, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, escapeMetricHelp(help), name, kind, name, formatMetricValue(v))
+}
+
+func metricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeMetricLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	metricHelpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	metricLabelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeMetricHelp(s string) string  { return metricHelpReplacer.Replace(s) }
+func escapeMetricLabel(s string) string { return metricLabelReplacer.Replace(s) }
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,41 @@
+package seaeye
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricRegistry(t *testing.T) {
+	r := &metricRegistry{}
+	c := r.counter("test_total", "Number of\ntests.", "repo")
+	g := r.gauge("test_remaining", "Remaining tests.")
+	h := r.histogram("test_seconds", "Duration of tests.", []float64{1, 10}, "repo")
+
+	c.Inc(`scraperwiki/"seaeye"`)
+	c.Add(2, "scraperwiki/hookbot")
+	g.Set(4.5)
+	h.Observe(0.5, "scraperwiki/seaeye")
+	h.Observe(5, "scraperwiki/seaeye")
+	h.Observe(50, "scraperwiki/seaeye")
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP test_total Number of\ntests.
+# TYPE test_total counter
+test_total{repo="scraperwiki/\"seaeye\""} 1
+test_total{repo="scraperwiki/hookbot"} 2
+# HELP test_remaining Remaining tests.
+# TYPE test_remaining gauge
+test_remaining 4.5
+# HELP test_seconds Duration of tests.
+# TYPE test_seconds histogram
+test_seconds_bucket{repo="scraperwiki/seaeye",le="1"} 1
+test_seconds_bucket{repo="scraperwiki/seaeye",le="10"} 2
+test_seconds_bucket{repo="scraperwiki/seaeye",le="+Inf"} 3
+test_seconds_sum{repo="scraperwiki/seaeye"} 55.5
+test_seconds_count{repo="scraperwiki/seaeye"} 3
+`, buf.String())
+}
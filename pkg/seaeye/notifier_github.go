@@ -1,14 +1,16 @@
 package seaeye
 
 import (
-	"log"
+	"unicode/utf8"
 
 	"github.com/google/go-github/github"
 )
 
 // GithubNotifier updates a repository commit state on Github.
 type GithubNotifier struct {
-	Client    *OAuthGithubClient
+	Client *OAuthGithubClient
+	// Context holds the status context, defaults to "seaeye".
+	Context   string
 	Source    *Source
 	TargetURL string
 }
@@ -16,7 +18,7 @@ type GithubNotifier struct {
 // Notify notifies a Github repository about status updates. State is required,
 // desc is optional.
 func (g *GithubNotifier) Notify(state, desc string) error {
-	context := "seaeye" // "ci"
+	context := g.context()
 	s := &github.RepoStatus{
 		Context:     &context,
 		Description: &desc,
@@ -24,13 +26,35 @@ func (g *GithubNotifier) Notify(state, desc string) error {
 		TargetURL:   &g.TargetURL,
 	}
 
-	log.Printf("[I][notifier_github] Notifying Github: %s - %s", *s.State, *s.Description)
+	l := notifierLog.With(sourceFields(g.Source)...)
+	l.Infof("Notifying Github: %s %s - %s", *s.Context, *s.State, *s.Description)
 	_, resp, err := g.Client.Repositories.CreateStatus(g.Source.Owner, g.Source.Repo, g.Source.Rev, s)
+	if resp != nil && resp.Limit > 0 {
+		metricGithubRateLimitRemaining.Set(float64(resp.Remaining))
+	}
 	if err != nil {
-		log.Printf("[E][notifier_github] Failed to notify Github: %v", err)
+		metricNotifierErrors.Inc(NotifierGithub)
+		l.Errorf("Failed to notify Github: %v", err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	return nil
 }
+
+func (g *GithubNotifier) context() string {
+	if g.Context == "" {
+		return "seaeye" // "ci"
+	}
+	return g.Context
+}
+
+// statusDescription shortens a description to the maximum length in
+// characters accepted by the Github status API.
+func statusDescription(desc string) string {
+	const maxLen = 140
+	if utf8.RuneCountInString(desc) <= maxLen {
+		return desc
+	}
+	return string([]rune(desc)[:maxLen-3]) + "..."
+}
@@ -0,0 +1,17 @@
+package seaeye
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusDescription(t *testing.T) {
+	assert.Equal(t, "ok", statusDescription("ok"))
+	desc := statusDescription("Invalid manifest: " + strings.Repeat("ü", 200))
+	assert.True(t, utf8.ValidString(desc))
+	assert.Equal(t, 140, utf8.RuneCountInString(desc))
+	assert.True(t, strings.HasSuffix(desc, "ü..."))
+}
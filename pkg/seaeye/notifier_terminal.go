@@ -0,0 +1,32 @@
+package seaeye
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/scraperwiki/seaeye/pkg/seaeye/ansi"
+)
+
+// TerminalNotifier prints status updates to a terminal.
+type TerminalNotifier struct {
+	Writer io.Writer
+	// Color decides if states are highlighted with ANSI colors.
+	Color bool
+}
+
+// Notify prints the state and description.
+func (t *TerminalNotifier) Notify(state, desc string) error {
+	s := fmt.Sprintf("[%s]", state)
+	if t.Color {
+		switch state {
+		case "success":
+			s = ansi.Colorize(ansi.Green, s)
+		case "failure", "error":
+			s = ansi.Colorize(ansi.Red, s)
+		default:
+			s = ansi.Colorize(ansi.Yellow, s)
+		}
+	}
+	_, err := fmt.Fprintf(t.Writer, "%s %s\n", s, desc)
+	return err
+}
@@ -0,0 +1,294 @@
+package seaeye
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/scraperwiki/seaeye/pkg/seaeye/ansi"
+)
+
+// searchIndexFile names the file next to a log file holding its search index.
+const searchIndexFile = "search.idx"
+
+// searchIndexHeader starts a search index, followed by the distinct trigrams
+// of the log's lines, lowercased and sorted, 3 bytes each.
+const searchIndexHeader = "seaeye search index 1\n"
+
+// Limits of search results.
+const (
+	searchDefaultLimit = 20  // logs
+	searchMaxLimit     = 100 // logs
+	searchMaxMatches   = 5   // excerpts per log
+	searchMaxExcerpt   = 300 // bytes per excerpt
+)
+
+// SearchQuery specifies a search of build logs, newest first, for lines
+// containing Text, ignoring case. Repo and Branch hold comma separated
+// patterns (see path.Match), e.g. "scraperwiki/*". Builds finished before
+// build records were kept only match without Branch and State.
+type SearchQuery struct {
+	Text   string
+	Repo   string
+	Branch string
+	State  string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // logs, up to searchMaxLimit
+}
+
+// SearchResult holds the matching lines of the log of a build, or of one of
+// its matrix cells.
+type SearchResult struct {
+	Job     string        `json:"job"` // escaped owner/repo
+	Rev     string        `json:"rev"`
+	Cell    string        `json:"cell,omitempty"`
+	Build   *BuildInfo    `json:"build,omitempty"`
+	Time    time.Time     `json:"time"`
+	URL     string        `json:"url"`
+	Count   int           `json:"count"` // matching lines
+	Matches []SearchMatch `json:"matches"`
+}
+
+// SearchMatch holds an excerpt of a matching line, with the byte ranges of
+// the matches within it, and a link to the line.
+type SearchMatch struct {
+	Line       int      `json:"line"`
+	Text       string   `json:"text"`
+	Highlights [][2]int `json:"highlights"`
+	URL        string   `json:"url"`
+}
+
+// Search searches the build logs as specified by q. Logs whose index rules
+// out a match are skipped, logs without index, e.g. of running builds, are
+// searched all the same.
+func Search(c *Config, q *SearchQuery) ([]*SearchResult, error) {
+	text := lowerASCII([]byte(q.Text))
+	if len(bytes.TrimSpace(text)) == 0 {
+		return nil, fmt.Errorf("empty search text")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	} else if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+
+	dirs, err := scanLogDirs(c.LogBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byTimeDesc(dirs))
+
+	results := []*SearchResult{}
+	for _, d := range dirs {
+		if !q.matches(d) {
+			continue
+		}
+		for _, p := range findLogs(d.path) {
+			r, err := searchLog(p, text)
+			if err != nil {
+				if !os.IsNotExist(err) { // removed by the janitor
+					webLog.Warnf("Failed to search log %s: %v", p, err)
+				}
+				continue
+			}
+			if r == nil {
+				continue
+			}
+
+			r.Job = filepath.Base(filepath.Dir(d.path))
+			r.Rev = filepath.Base(d.path)
+			if cell, err := filepath.Rel(d.path, filepath.Dir(p)); err == nil && cell != "." {
+				r.Cell = cell
+			}
+			r.Build = d.info
+			r.Time = d.time
+			r.URL = c.BaseURL + "/jobs/" + r.Job + "/status/" + r.Rev
+			if r.Cell != "" {
+				r.URL += "/" + r.Cell
+			}
+			for i := range r.Matches {
+				r.Matches[i].URL = fmt.Sprintf("%s#L%d", r.URL, r.Matches[i].Line)
+			}
+
+			results = append(results, r)
+			if len(results) == limit {
+				return results, nil
+			}
+		}
+	}
+	return results, nil
+}
+
+// matches decides if the build of a log directory matches the filters of q.
+func (q *SearchQuery) matches(d *logDir) bool {
+	if (!q.Since.IsZero() && d.time.Before(q.Since)) || (!q.Until.IsZero() && !d.time.Before(q.Until)) {
+		return false
+	}
+	if d.info == nil {
+		return q.Branch == "" && q.State == "" && (q.Repo == "" || matchAny(splitList(escapePath(q.Repo)), d.repo))
+	}
+	return matchAny(splitList(q.Repo), d.info.Owner+"/"+d.info.Repo) &&
+		(q.Branch == "" || matchAny(splitList(q.Branch), branchName(d.info.Ref))) &&
+		(q.State == "" || q.State == d.info.State)
+}
+
+// findLogs returns the paths of the log files in a build's log directory, of
+// the build and of its matrix cells, compressed or not.
+func findLogs(dir string) []string {
+	var logs []string
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && (fi.Name() == "log.txt" || fi.Name() == "log.txt.gz") {
+			logs = append(logs, filepath.Join(filepath.Dir(p), "log.txt"))
+		}
+		return nil
+	})
+	return logs
+}
+
+// searchLog returns the lines of a log containing text, which is lowercase,
+// ignoring ANSI escape sequences, or nil if there are none.
+func searchLog(logFilePath string, text []byte) (*SearchResult, error) {
+	if idx, err := ioutil.ReadFile(filepath.Join(filepath.Dir(logFilePath), searchIndexFile)); err == nil && !indexMayMatch(idx, text) {
+		return nil, nil
+	}
+	b, err := readLogFile(logFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &SearchResult{}
+	for i, line := range bytes.Split(ansi.Strip(b), []byte("\n")) {
+		lower := lowerASCII(line)
+		if !bytes.Contains(lower, text) {
+			continue
+		}
+		r.Count++
+		if len(r.Matches) < searchMaxMatches {
+			r.Matches = append(r.Matches, excerpt(i+1, line, lower, text))
+		}
+	}
+	if r.Count == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// excerpt returns the part of a line around the first match of text, with all
+// matches within highlighted.
+func excerpt(n int, line, lower, text []byte) SearchMatch {
+	start, end := 0, len(line)
+	if end > searchMaxExcerpt {
+		start = bytes.Index(lower, text) - searchMaxExcerpt/3
+		if start < 0 {
+			start = 0
+		}
+		for start > 0 && !utf8.RuneStart(line[start]) {
+			start--
+		}
+		end = start + searchMaxExcerpt
+		if end > len(line) {
+			end = len(line)
+		}
+		for end < len(line) && !utf8.RuneStart(line[end]) {
+			end--
+		}
+	}
+
+	m := SearchMatch{Line: n, Text: string(line[start:end]), Highlights: [][2]int{}}
+	for i := start; i < end; {
+		j := bytes.Index(lower[i:end], text)
+		if j < 0 {
+			break
+		}
+		i += j
+		m.Highlights = append(m.Highlights, [2]int{i - start, i - start + len(text)})
+		i += len(text)
+	}
+	return m
+}
+
+// indexBuildLogs writes the search index of every log of a build.
+func indexBuildLogs(c *Config, b *Build) error {
+	p, err := b.LogFilePath(c)
+	if err != nil {
+		return err
+	}
+	for _, logFilePath := range findLogs(filepath.Dir(p)) {
+		if err := indexLog(logFilePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexLog writes the search index of a log file: the set of the trigrams of
+// its lines, lowercased and without ANSI escape sequences. A search for text of
+// at least 3 bytes skips logs missing any of its trigrams.
+func indexLog(logFilePath string) error {
+	b, err := readLogFile(logFilePath)
+	if err != nil {
+		return err
+	}
+	set := map[uint32]bool{}
+	for _, line := range bytes.Split(lowerASCII(ansi.Strip(b)), []byte("\n")) {
+		for i := 0; i+3 <= len(line); i++ {
+			set[uint32(line[i])<<16|uint32(line[i+1])<<8|uint32(line[i+2])] = true
+		}
+	}
+	trigrams := make([]int, 0, len(set))
+	for t := range set {
+		trigrams = append(trigrams, int(t))
+	}
+	sort.Ints(trigrams)
+
+	buf := bytes.NewBufferString(searchIndexHeader)
+	for _, t := range trigrams {
+		buf.Write([]byte{byte(t >> 16), byte(t >> 8), byte(t)})
+	}
+	p := filepath.Join(filepath.Dir(logFilePath), searchIndexFile)
+	if err := ioutil.WriteFile(p+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+// indexMayMatch decides if a log may contain text, which is lowercase, as per
+// its search index. Invalid indexes rule out nothing.
+func indexMayMatch(idx, text []byte) bool {
+	if !bytes.HasPrefix(idx, []byte(searchIndexHeader)) {
+		return true
+	}
+	trigrams := idx[len(searchIndexHeader):]
+	if len(trigrams)%3 != 0 {
+		return true
+	}
+	n := len(trigrams) / 3
+	for i := 0; i+3 <= len(text); i++ {
+		t := text[i : i+3]
+		j := sort.Search(n, func(j int) bool { return bytes.Compare(trigrams[3*j:3*j+3], t) >= 0 })
+		if j == n || !bytes.Equal(trigrams[3*j:3*j+3], t) {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerASCII returns a copy of b with ASCII letters lowercased, keeping the
+// offsets of all bytes, unlike bytes.ToLower.
+func lowerASCII(b []byte) []byte {
+	lower := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return lower
+}
@@ -0,0 +1,68 @@
+package seaeye
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seaeye-search-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Config{BaseURL: "https://ci.example.com", LogBaseDir: dir}
+	now := time.Now()
+	addLog := func(rev, ref, state, log string, finished time.Time) *Build {
+		b := &Build{Source: &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: rev, Ref: ref}, State: state, Finished: finished}
+		p, err := b.LogFilePath(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(log), 0644))
+		assert.NoError(t, saveBuildInfo(c, b, b.info()))
+		return b
+	}
+	flaky := addLog("a1", "refs/heads/master", "failure", "ok\nError: \x1b[31mConnection REFUSED\x1b[0m, connection refused\n", now.Add(-time.Hour))
+	addLog("a2", "refs/heads/feature", "failure", "Error: connection refused\n", now)
+	unindexed := addLog("a3", "refs/heads/master", "success", "all fine\n", now.Add(-2*time.Hour))
+	assert.NoError(t, indexBuildLogs(c, flaky))
+
+	results, err := Search(c, &SearchQuery{Text: "connection refused", Branch: "master"})
+	assert.NoError(t, err)
+	if !assert.Len(t, results, 1) {
+		return
+	}
+	r := results[0]
+	assert.Equal(t, "a1", r.Rev)
+	assert.Equal(t, 1, r.Count)
+	assert.Equal(t, []SearchMatch{{
+		Line:       2,
+		Text:       "Error: Connection REFUSED, connection refused",
+		Highlights: [][2]int{{7, 25}, {27, 45}},
+		URL:        "https://ci.example.com/jobs/scraperwiki_seaeye/status/a1#L2",
+	}}, r.Matches)
+
+	results, err = Search(c, &SearchQuery{Text: "refused", State: "failure"})
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	results, err = Search(c, &SearchQuery{Text: "refused", Since: now.Add(-time.Minute)})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	// The index rules out logs, unindexed logs are searched.
+	p, _ := flaky.LogFilePath(c)
+	assert.NoError(t, ioutil.WriteFile(p, []byte("all fine\n"), 0644))
+	results, err = Search(c, &SearchQuery{Text: "fine", Repo: "scraperwiki/*"})
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, unindexed.Source.Rev, results[0].Rev)
+	}
+}
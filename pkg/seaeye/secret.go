@@ -0,0 +1,171 @@
+package seaeye
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const secretKeyBits = 2048
+
+// ErrInvalidSecret is returned if a secret can't be decoded.
+var ErrInvalidSecret = errors.New("invalid secret")
+
+// SecretKey is the server's private key to decrypt manifest secrets with.
+//
+// Secrets are encrypted with a random AES-256-GCM key, which itself is
+// encrypted with the server's public key using RSA-OAEP. Both are bound to the
+// repository (owner/repo) the secret is meant for, so a secret copied to
+// another repository can't be decrypted.
+type SecretKey struct {
+	*rsa.PrivateKey
+}
+
+// LoadSecretKey reads a PEM encoded RSA private key, generating and writing a
+// new one first if the file doesn't exist.
+func LoadSecretKey(path string) (*SecretKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		secretLog.Infof("Generating secret key: %s", path)
+		return generateSecretKey(path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read secret key: %v", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, fmt.Errorf("failed to parse secret key %s: no RSA private key found", path)
+	}
+	k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse secret key %s: %v", path, err)
+	}
+	return &SecretKey{PrivateKey: k}, nil
+}
+
+func generateSecretKey(path string) (*SecretKey, error) {
+	k, err := rsa.GenerateKey(rand.Reader, secretKeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret key: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create secret key directory: %v", err)
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write secret key: %v", err)
+	}
+	return &SecretKey{PrivateKey: k}, nil
+}
+
+// PublicKeyPEM returns the PEM encoded public key to encrypt secrets with.
+func (k *SecretKey) PublicKeyPEM() ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), nil
+}
+
+// ParsePublicKeyPEM parses a PEM encoded RSA public key as returned by
+// PublicKeyPEM.
+func ParsePublicKeyPEM(b []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("failed to parse public key: no public key found")
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	pub, ok := k.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse public key: not an RSA key")
+	}
+	return pub, nil
+}
+
+// EncryptSecret encrypts a secret value for a repository (owner/repo) and
+// returns it base64 encoded, as expected by the manifest's secrets section.
+func EncryptSecret(pub *rsa.PublicKey, repo, value string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, []byte(repo))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt secret: %v", err)
+	}
+
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	b := append(wrapped, nonce...)
+	b = gcm.Seal(b, nonce, []byte(value), []byte(repo))
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Decrypt decrypts a secret encrypted by EncryptSecret for a repository
+// (owner/repo).
+func (k *SecretKey) Decrypt(repo, secret string) (string, error) {
+	b, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	size := k.PublicKey.N.BitLen() / 8
+	if len(b) < size {
+		return "", ErrInvalidSecret
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, k.PrivateKey, b[:size], []byte(repo))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret for %s: %v", repo, err)
+	}
+
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	b = b[size:]
+	if len(b) < gcm.NonceSize() {
+		return "", ErrInvalidSecret
+	}
+	value, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], []byte(repo))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret for %s: %v", repo, err)
+	}
+	return string(value), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || len(b) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return b, nil
+}
+
+func newSecretCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
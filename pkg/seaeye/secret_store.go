@@ -0,0 +1,242 @@
+package seaeye
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSecretNotFound is returned if a secret doesn't exist in a scope.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretInfo describes a stored secret without revealing its value.
+type SecretInfo struct {
+	Scope   string    `json:"scope"`
+	Name    string    `json:"name"`
+	Updated time.Time `json:"updated"`
+}
+
+type storedSecret struct {
+	SecretInfo
+	Value string `json:"value"`
+}
+
+// SecretStore holds secrets scoped globally (""), to an owner ("owner"), or to
+// a repository ("owner/repo"), encrypted at rest in a single file. Changes are
+// written through immediately and are visible to the next build.
+type SecretStore struct {
+	path    string
+	key     []byte
+	mu      sync.RWMutex
+	secrets map[string]map[string]*storedSecret // scope > name > secret
+}
+
+// OpenSecretStore opens the secret store at path, encrypted with a base64
+// encoded 256 bit key. A missing file is an empty store.
+func OpenSecretStore(path, key string) (*SecretStore, error) {
+	k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(k) != 32 {
+		return nil, fmt.Errorf("invalid secret store key: expected 32 base64 encoded bytes")
+	}
+
+	s := &SecretStore{path: path, key: k, secrets: map[string]map[string]*storedSecret{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read secret store: %v", err)
+	}
+
+	gcm, err := newSecretCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, fmt.Errorf("failed to decrypt secret store %s: too short", path)
+	}
+	b, err = gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret store %s: %v", path, err)
+	}
+
+	var secrets []*storedSecret
+	if err := json.Unmarshal(b, &secrets); err != nil {
+		return nil, fmt.Errorf("failed to parse secret store %s: %v", path, err)
+	}
+	for _, secret := range secrets {
+		s.scope(secret.Scope)[secret.Name] = secret
+	}
+	return s, nil
+}
+
+// List returns all secrets of a scope, or of all scopes if scope is "*",
+// sorted by scope and name.
+func (s *SecretStore) List(scope string) []*SecretInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var infos []*SecretInfo
+	for sc, secrets := range s.secrets {
+		if scope != "*" && sc != scope {
+			continue
+		}
+		for _, secret := range secrets {
+			info := secret.SecretInfo
+			infos = append(infos, &info)
+		}
+	}
+	sort.Sort(secretInfosByScopeName(infos))
+	return infos
+}
+
+// Set adds or replaces a secret.
+func (s *SecretStore) Set(scope, name, value string) (*SecretInfo, error) {
+	if err := validateSecretScope(scope); err != nil {
+		return nil, err
+	}
+	if !envVarNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid secret name %q", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret := &storedSecret{
+		SecretInfo: SecretInfo{Scope: scope, Name: name, Updated: time.Now().UTC()},
+		Value:      value,
+	}
+	previous := s.scope(scope)[name]
+	s.scope(scope)[name] = secret
+	if err := s.save(); err != nil {
+		if previous != nil {
+			s.scope(scope)[name] = previous
+		} else {
+			delete(s.scope(scope), name)
+		}
+		return nil, err
+	}
+	info := secret.SecretInfo
+	return &info, nil
+}
+
+// Delete removes a secret.
+func (s *SecretStore) Delete(scope, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.secrets[scope][name]
+	if !ok {
+		return ErrSecretNotFound
+	}
+	delete(s.secrets[scope], name)
+	if err := s.save(); err != nil {
+		s.secrets[scope][name] = secret
+		return err
+	}
+	return nil
+}
+
+// Env returns the secrets of a repository as environment variables, with
+// repository secrets taking precedence over owner secrets, and owner secrets
+// over global ones.
+func (s *SecretStore) Env(owner, repo string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var envs [][]string
+	for _, scope := range []string{"", owner, owner + "/" + repo} {
+		var env []string
+		for name, secret := range s.secrets[scope] {
+			env = append(env, name+"="+secret.Value)
+		}
+		sort.Strings(env)
+		envs = append(envs, env)
+	}
+	return mergeEnv(envs...)
+}
+
+func (s *SecretStore) scope(scope string) map[string]*storedSecret {
+	secrets, ok := s.secrets[scope]
+	if !ok {
+		secrets = map[string]*storedSecret{}
+		s.secrets[scope] = secrets
+	}
+	return secrets
+}
+
+// save encrypts and atomically writes all secrets. The caller must hold the
+// write lock.
+func (s *SecretStore) save() error {
+	var secrets []*storedSecret
+	for _, scope := range s.secrets {
+		for _, secret := range scope {
+			secrets = append(secrets, secret)
+		}
+	}
+	b, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newSecretCipher(s.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	b = gcm.Seal(nonce, nonce, b, nil)
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create secret store directory: %v", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), ".secrets-")
+	if err != nil {
+		return fmt.Errorf("failed to write secret store: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write secret store: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write secret store: %v", err)
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write secret store: %v", err)
+	}
+	return nil
+}
+
+// validateSecretScope accepts the global scope "", an owner, or an owner/repo.
+func validateSecretScope(scope string) error {
+	if scope == "" {
+		return nil
+	}
+	parts := strings.Split(scope, "/")
+	if len(parts) > 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+		return fmt.Errorf("invalid scope %q (expected owner or owner/repo)", scope)
+	}
+	return nil
+}
+
+type secretInfosByScopeName []*SecretInfo
+
+func (s secretInfosByScopeName) Len() int      { return len(s) }
+func (s secretInfosByScopeName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s secretInfosByScopeName) Less(i, j int) bool {
+	if s[i].Scope != s[j].Scope {
+		return s[i].Scope < s[j].Scope
+	}
+	return s[i].Name < s[j].Name
+}
@@ -0,0 +1,57 @@
+package seaeye
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecretStoreKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestSecretStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seaeye-secrets-")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.enc")
+
+	s, err := OpenSecretStore(path, testSecretStoreKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, secret := range [][3]string{
+		{"", "TOKEN", "global"},
+		{"", "GLOBAL", "1"},
+		{"scraperwiki", "TOKEN", "owner"},
+		{"scraperwiki/seaeye", "TOKEN", "repo"},
+		{"scraperwiki/other", "OTHER", "other"},
+	} {
+		_, err := s.Set(secret[0], secret[1], secret[2])
+		assert.NoError(t, err)
+	}
+	_, err = s.Set("a/b/c", "TOKEN", "x")
+	assert.Error(t, err)
+	_, err = s.Set("", "NO-NAME", "x")
+	assert.Error(t, err)
+
+	s, err = OpenSecretStore(path, testSecretStoreKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"GLOBAL=1", "TOKEN=repo"}, s.Env("scraperwiki", "seaeye"))
+	assert.Equal(t, []string{"GLOBAL=1", "TOKEN=owner"}, s.Env("scraperwiki", "hookbot"))
+	assert.Equal(t, []string{"GLOBAL=1", "TOKEN=global"}, s.Env("someone", "seaeye"))
+	assert.Len(t, s.List("*"), 5)
+	assert.Len(t, s.List(""), 2)
+
+	assert.NoError(t, s.Delete("scraperwiki/seaeye", "TOKEN"))
+	assert.Equal(t, ErrSecretNotFound, s.Delete("scraperwiki/seaeye", "TOKEN"))
+	assert.Equal(t, []string{"GLOBAL=1", "TOKEN=owner"}, s.Env("scraperwiki", "seaeye"))
+
+	_, err = OpenSecretStore(path, "MTIzNDU2Nzg5MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTI=")
+	assert.Error(t, err)
+}
@@ -0,0 +1,46 @@
+package seaeye
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seaeye-secret-")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "seaeye.key")
+	k, err := LoadSecretKey(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	loaded, err := LoadSecretKey(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, k.D, loaded.D)
+
+	pemBytes, err := k.PublicKeyPEM()
+	assert.NoError(t, err)
+	pub, err := ParsePublicKeyPEM(pemBytes)
+	assert.NoError(t, err)
+
+	secret, err := EncryptSecret(pub, "scraperwiki/seaeye", "s3cr3t")
+	assert.NoError(t, err)
+
+	v, err := loaded.Decrypt("scraperwiki/seaeye", secret)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", v)
+
+	_, err = loaded.Decrypt("someone/seaeye", secret)
+	assert.Error(t, err)
+	_, err = loaded.Decrypt("scraperwiki/seaeye", "bm9wZQ==")
+	assert.Equal(t, ErrInvalidSecret, err)
+}
@@ -0,0 +1,105 @@
+package seaeye
+
+import "fmt"
+
+// Stage defines a named list of commands in a pipeline.
+type Stage struct {
+	Name string
+	// Needs holds the names of all stages that have to succeed before this
+	// stage can run. A stage whose needs are not met is skipped.
+	Needs []string `yaml:",omitempty"`
+	// Relevant decides if the stage's result affects the commit status.
+	// Defaults to true.
+	Relevant *bool `yaml:",omitempty"`
+	// AllowFailure ignores the stage's failure, both for the commit status and
+	// for any stages depending on it.
+	AllowFailure bool      `yaml:"allow_failure,omitempty"`
+	Commands     []Command `yaml:",omitempty,flow"`
+}
+
+// IsRelevant returns if the stage's result affects the commit status.
+func (s *Stage) IsRelevant() bool {
+	return !s.AllowFailure && (s.Relevant == nil || *s.Relevant)
+}
+
+// Pipeline returns the manifest's stages in execution order. Version 1
+// manifests form an implicit pipeline Pre > Test > Post, where only Test is
+// relevant and no stage depends on another.
+func (m *Manifest) Pipeline() ([]*Stage, error) {
+	if m.Version < 2 {
+		relevant, irrelevant := true, false
+		return []*Stage{
+			&Stage{Name: "Pre", Relevant: &irrelevant, Commands: m.Pre},
+			&Stage{Name: "Test", Relevant: &relevant, Commands: m.Test},
+			&Stage{Name: "Post", Relevant: &irrelevant, Commands: m.Post},
+		}, nil
+	}
+	return sortStages(m.Stages)
+}
+
+// sortStages orders stages topologically, keeping the manifest order among
+// stages that don't depend on each other.
+func sortStages(stages []*Stage) ([]*Stage, error) {
+	byName := map[string]*Stage{}
+	for _, s := range stages {
+		if s.Name == "" {
+			return nil, fmt.Errorf("stage without name")
+		}
+		if _, ok := byName[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate stage %s", s.Name)
+		}
+		byName[s.Name] = s
+	}
+	for _, s := range stages {
+		for _, n := range s.Needs {
+			if _, ok := byName[n]; !ok {
+				return nil, fmt.Errorf("stage %s needs unknown stage %s", s.Name, n)
+			}
+		}
+	}
+
+	var sorted []*Stage
+	done := map[string]bool{}
+	for len(sorted) < len(stages) {
+		progress := false
+		for _, s := range stages {
+			if done[s.Name] || !needsDone(s, done) {
+				continue
+			}
+			sorted = append(sorted, s)
+			done[s.Name] = true
+			progress = true
+			break
+		}
+		if !progress {
+			var cyclic []string
+			for _, s := range stages {
+				if !done[s.Name] {
+					cyclic = append(cyclic, s.Name)
+				}
+			}
+			return nil, fmt.Errorf("stages %v have cyclic needs", cyclic)
+		}
+	}
+	return sorted, nil
+}
+
+func needsDone(s *Stage, done map[string]bool) bool {
+	for _, n := range s.Needs {
+		if !done[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// needsState returns the commit state of the first failed or skipped need of
+// a stage, as held by failed.
+func needsState(s *Stage, failed map[string]string) string {
+	for _, n := range s.Needs {
+		if state, ok := failed[n]; ok {
+			return state
+		}
+	}
+	return "failure"
+}
@@ -0,0 +1,146 @@
+package seaeye
+
+import (
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSortStages(t *testing.T) {
+	stages := []*Stage{
+		&Stage{Name: "deploy", Needs: []string{"test", "lint"}},
+		&Stage{Name: "test", Needs: []string{"build"}},
+		&Stage{Name: "build"},
+		&Stage{Name: "lint"},
+	}
+	sorted, err := sortStages(stages)
+	assert.NoError(t, err)
+
+	var names []string
+	for _, s := range sorted {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"build", "test", "lint", "deploy"}, names)
+}
+
+func TestSortStagesErrors(t *testing.T) {
+	_, err := sortStages([]*Stage{&Stage{Name: "a", Needs: []string{"b"}}})
+	assert.EqualError(t, err, "stage a needs unknown stage b")
+
+	_, err = sortStages([]*Stage{&Stage{Name: "a"}, &Stage{Name: "a"}})
+	assert.EqualError(t, err, "duplicate stage a")
+
+	_, err = sortStages([]*Stage{
+		&Stage{Name: "a", Needs: []string{"b"}},
+		&Stage{Name: "b", Needs: []string{"a"}},
+		&Stage{Name: "c"},
+	})
+	assert.EqualError(t, err, "stages [a b] have cyclic needs")
+}
+
+// recordingNotifier records the commit states it gets notified of.
+type recordingNotifier struct {
+	states []string
+}
+
+func (n *recordingNotifier) Notify(state, desc string) error {
+	n.states = append(n.states, state+": "+desc)
+	return nil
+}
+
+func runStages(t *testing.T, stages ...*Stage) (string, []string, error) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	n := &recordingNotifier{}
+	j := &Job{
+		Config:   &Config{},
+		ID:       "scraperwiki_seaeye",
+		Logger:   NewTerminalLogger(devNull, "", log.LstdFlags),
+		Manifest: &Manifest{Version: 2, Stages: stages},
+		Notifier: n,
+		repo:     &RepoConfig{ExecTimeout: time.Minute},
+		source:   &Source{Owner: "scraperwiki", Repo: "seaeye", Rev: "abc"},
+	}
+	result, err := j.runPipeline(context.Background(), ".", os.Environ())
+	return result, n.states, err
+}
+
+func TestRunPipelineAllowFailure(t *testing.T) {
+	fail := []Command{{Args: []string{"false"}}}
+	pass := []Command{{Args: []string{"true"}}}
+
+	// A stage allowed to fail counts as succeeded, also for its dependents.
+	result, states, err := runStages(t,
+		&Stage{Name: "bench", AllowFailure: true, Commands: fail},
+		&Stage{Name: "report", Needs: []string{"bench"}, Commands: pass},
+	)
+	assert.Equal(t, "success", result)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"pending: Stage bench started",
+		"pending: Stage report started",
+		"success: All stages succeeded",
+	}, states)
+
+	// Without allow_failure, the dependents are skipped.
+	result, states, err = runStages(t,
+		&Stage{Name: "build", Commands: fail},
+		&Stage{Name: "test", Needs: []string{"build"}, Commands: pass},
+	)
+	assert.Equal(t, "failure", result)
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"pending: Stage build started",
+		"failure: Stage build failed",
+	}, states)
+}
+
+func TestRunPipelineSkippedRelevant(t *testing.T) {
+	irrelevant := false
+	result, states, err := runStages(t,
+		&Stage{Name: "build", Relevant: &irrelevant, Commands: []Command{{Args: []string{"false"}}}},
+		&Stage{Name: "test", Needs: []string{"build"}, Commands: []Command{{Args: []string{"true"}}}},
+		&Stage{Name: "deploy", Needs: []string{"test"}, Commands: []Command{{Args: []string{"true"}}}},
+	)
+	assert.Equal(t, "failure", result)
+	assert.EqualError(t, err, "stage test skipped: needs [build]")
+	assert.Equal(t, []string{
+		"pending: Stage build started",
+		"failure: Stage test skipped",
+	}, states)
+}
+
+func TestRunPipelineIrrelevantFailure(t *testing.T) {
+	// A failing irrelevant stage agrees with the commit status.
+	irrelevant := false
+	result, states, err := runStages(t,
+		&Stage{Name: "test", Commands: []Command{{Args: []string{"true"}}}},
+		&Stage{Name: "post", Relevant: &irrelevant, Commands: []Command{{Args: []string{"false"}}}},
+	)
+	assert.Equal(t, "success", result)
+	assert.NoError(t, err)
+	assert.Equal(t, "success: All stages succeeded", states[len(states)-1])
+}
+
+func TestValidateNoRelevantStage(t *testing.T) {
+	// Without a relevant stage, every build would report success.
+	_, err := ParseManifest([]byte(`version: 2
+stages:
+  - name: lint
+    relevant: false
+    commands: [make lint]
+  - name: bench
+    allow_failure: true
+    commands: [make bench]
+`))
+	if assert.IsType(t, ManifestErrors{}, err) {
+		assert.EqualError(t, err, "line 2, column 1: stages: no relevant stage, every stage is relevant: false or allow_failure")
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/scraperwiki/hookbot/pkg/listen"
@@ -13,13 +14,13 @@ import (
 
 // SubEvent specifies a Hookbot event. Example:
 //
-// github.com/repo/scraperwiki/pdftables.com/branch/fix-make-it-dev␀{
-//   "Branch":"fix-make-it-dev",
-//   "Repo":"scraperwiki/pdftables.com",
-//   "SHA":"dc1329177775c1c72c0a16f4b2d42d2e3d701c19",
-//   "Type":"push",
-//   "Who":"djui"
-// }
+//	github.com/repo/scraperwiki/pdftables.com/branch/fix-make-it-dev␀{
+//	  "Branch":"fix-make-it-dev",
+//	  "Repo":"scraperwiki/pdftables.com",
+//	  "SHA":"dc1329177775c1c72c0a16f4b2d42d2e3d701c19",
+//	  "Type":"push",
+//	  "Who":"djui"
+//	}
 type SubEvent struct {
 	Branch string
 	Repo   string
@@ -28,6 +29,10 @@ type SubEvent struct {
 	Who    string
 }
 
+// hookbotErrorWindow defines how long a subscription error marks the
+// subscription as disconnected, unless a message arrives in between.
+const hookbotErrorWindow = time.Minute
+
 // HookbotTrigger specifies a Hookbot subscriber instance.
 type HookbotTrigger struct {
 	Endpoint string
@@ -35,12 +40,16 @@ type HookbotTrigger struct {
 	errCh    <-chan error
 	finishCh chan struct{}
 	msgCh    <-chan []byte
+	mu       sync.Mutex
+	lastErr  error
+	errTime  time.Time
+	msgTime  time.Time
 }
 
 // Start starts a retrying Hookbot listener subscribing to a given endpoint.
 func (h *HookbotTrigger) Start() error {
-	finishCh := make(chan struct{})
-	msgCh, errCh := listen.RetryingWatch(h.Endpoint, http.Header{}, finishCh)
+	h.finishCh = make(chan struct{})
+	msgCh, errCh := listen.RetryingWatch(h.Endpoint, http.Header{}, h.finishCh)
 	go h.errorHandler(errCh)
 	go h.msgHandler(msgCh)
 	return nil
@@ -48,19 +57,36 @@ func (h *HookbotTrigger) Start() error {
 
 // Stop unsubscribes and stops a retrying Hookbot listener.
 func (h *HookbotTrigger) Stop() error {
-	h.finishCh <- struct{}{}
 	close(h.finishCh)
 	return nil
 }
 
+// Connected returns the last subscription error, unless a message arrived
+// since or it is older than hookbotErrorWindow.
+func (h *HookbotTrigger) Connected() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastErr == nil || h.msgTime.After(h.errTime) || time.Since(h.errTime) > hookbotErrorWindow {
+		return nil
+	}
+	return h.lastErr
+}
+
 func (h *HookbotTrigger) errorHandler(errCh <-chan error) {
 	for err := range errCh {
-		log.Printf("[W][trigger_hookbot] Subscription error for %s: %v", h.Endpoint, err)
+		triggerLog.Warnf("Subscription error for %s: %v", h.Endpoint, err)
+		h.mu.Lock()
+		h.lastErr, h.errTime = err, time.Now()
+		h.mu.Unlock()
 	}
 }
 
 func (h *HookbotTrigger) msgHandler(msgCh <-chan []byte) {
 	for msg := range msgCh {
+		h.mu.Lock()
+		h.msgTime = time.Now()
+		h.mu.Unlock()
+
 		// Recursive topic messages are of format '{path}␀{data}'.
 		parts := bytes.Split(msg, []byte{'\x00'})
 		if len(parts) == 2 {
@@ -69,11 +95,11 @@ func (h *HookbotTrigger) msgHandler(msgCh <-chan []byte) {
 
 		var event SubEvent
 		if err := json.Unmarshal(msg, &event); err != nil {
-			log.Printf("[W][trigger_hookbot] Event [E]%v: %s", err, string(msg[:]))
+			triggerLog.Warnf("Event [E]%v: %s", err, string(msg[:]))
 			continue
 		}
 
-		log.Printf("[D][trigger_hookbot] Event: %s %s", event.Repo, event.SHA)
+		triggerLog.With("repo", event.Repo, "sha", event.SHA).Debugf("Event: %s %s", event.Repo, event.SHA)
 
 		if event.Type != "push" {
 			continue
@@ -102,14 +128,14 @@ func (h *HookbotTrigger) msgHandler(msgCh <-chan []byte) {
 		}
 
 		if h.Hook == nil {
-			log.Printf("[W][trigger_hookbot] No hook defined for: %v", e)
+			triggerLog.Warnf("No hook defined for: %v", e)
 			continue
 		}
 
 		// Execute hooks sequential for now, as parallel will likely cause
 		// resource conflicts and/or race-conditions.
 		if err := h.Hook(&e); err != nil {
-			log.Printf("[E][trigger_hookbot] Hook failed: %v %v", e, err)
+			triggerLog.Errorf("Hook failed: %v %v", e, err)
 		}
 	}
 }
@@ -0,0 +1,166 @@
+package seaeye
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// BuildVariables lists the variables describing a build which are exposed to
+// every command and can be referenced in the manifest.
+var BuildVariables = []string{
+	"CI",
+	"SEAEYE_BRANCH",
+	"SEAEYE_BUILD_ID",
+	"SEAEYE_BUILD_URL",
+	"SEAEYE_OWNER",
+	"SEAEYE_PUSHER",
+	"SEAEYE_REF",
+	"SEAEYE_REPO",
+	"SEAEYE_SHA",
+	"WORKSPACE",
+	"DOCKER_WORKSPACE",
+}
+
+// hostVariables lists the variables of the server's environment which can be
+// referenced in the manifest. All others are unknown at validation time and
+// are left to the shell.
+var hostVariables = []string{"HOME", "LANG", "PATH", "SHELL", "TMPDIR", "USER"}
+
+// buildEnv returns the build variables of the job checked out at wd.
+func (j *Job) buildEnv(wd string) []string {
+	s := j.source
+	return []string{
+		"CI=true",
+		"SEAEYE_BRANCH=" + branchName(s.Ref),
+		"SEAEYE_BUILD_ID=" + j.BuildID,
+		"SEAEYE_BUILD_URL=" + j.targetURL(""),
+		"SEAEYE_OWNER=" + s.Owner,
+		"SEAEYE_PUSHER=" + s.Pusher,
+		"SEAEYE_REF=" + s.Ref,
+		"SEAEYE_REPO=" + s.Repo,
+		"SEAEYE_SHA=" + s.Rev,
+		"WORKSPACE=" + wd,
+		"DOCKER_WORKSPACE=" + path.Join(j.Config.DockerHostVolumeBaseDir, wd),
+	}
+}
+
+// branchName returns the branch name of a ref, or an empty string if the ref
+// is not a branch.
+func branchName(ref string) string {
+	const prefix = "refs/heads/"
+	if !strings.HasPrefix(ref, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(ref, prefix)
+}
+
+// interpolate replaces every ${NAME} in s for which mapping returns a value.
+// A literal "${" is written as "$${". All other references, e.g. to unknown
+// variables or ${NAME:-default}, and other uses of "$" are left to the shell.
+func interpolate(s string, mapping func(string) (string, bool)) string {
+	out, _ := expandVariables(s, mapping, false)
+	return out
+}
+
+// checkVariables returns an error for the first reference in s to a variable
+// not in defined, or not of the form ${NAME}.
+func checkVariables(s string, defined map[string]bool) error {
+	_, err := expandVariables(s, func(name string) (string, bool) {
+		return "", defined[name]
+	}, true)
+	return err
+}
+
+// expandVariables implements interpolate, rejecting the references it leaves
+// untouched if strict.
+func expandVariables(s string, mapping func(string) (string, bool), strict bool) (string, error) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			out = append(out, s[i])
+			continue
+		}
+		rest := s[i+1:]
+		switch {
+		case strings.HasPrefix(rest, "${"):
+			out = append(out, "${"...)
+			i += 2
+		case strings.HasPrefix(rest, "{"):
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				if strict {
+					return "", fmt.Errorf("unterminated variable reference %q", s[i:])
+				}
+				out = append(out, '$')
+				continue
+			}
+			name := rest[1:end]
+			if !envVarNamePattern.MatchString(name) {
+				if strict {
+					return "", fmt.Errorf("invalid variable reference %q (write $${ for a literal ${)", "${"+name+"}")
+				}
+				out = append(out, '$')
+				continue
+			}
+			v, ok := mapping(name)
+			if !ok {
+				if strict {
+					return "", fmt.Errorf("undefined variable %q", name)
+				}
+				out = append(out, '$')
+				continue
+			}
+			out = append(out, v...)
+			i += end + 1
+		default:
+			out = append(out, '$')
+		}
+	}
+	return string(out), nil
+}
+
+// commandVariables returns the names of the variables that get replaced in
+// commands: the build variables, the variables of the server's environment
+// listed in hostVariables, and those defined by the manifest.
+func (m *Manifest) commandVariables() map[string]bool {
+	names := map[string]bool{"SEAEYE_TEST_RESULT": true}
+	for _, list := range [][]string{BuildVariables, hostVariables} {
+		for _, name := range list {
+			names[name] = true
+		}
+	}
+	for _, e := range m.Environment {
+		names[strings.SplitN(e, "=", 2)[0]] = true
+	}
+	for name := range m.Secrets {
+		names[name] = true
+	}
+	if m.Matrix != nil {
+		for name := range m.Matrix.Env {
+			names[name] = true
+		}
+		for _, e := range m.Matrix.Include {
+			for name := range e {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+// envMapping returns a mapping of variable names to values of env, with later
+// values taking precedence over earlier ones of the same name. Variables not
+// in env map to an empty value.
+func envMapping(env []string) func(string) (string, bool) {
+	vars := map[string]string{}
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	return func(name string) (string, bool) {
+		return vars[name], true
+	}
+}
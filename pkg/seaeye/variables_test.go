@@ -0,0 +1,56 @@
+package seaeye
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolate(t *testing.T) {
+	values := envMapping([]string{"A=1", "B=2", "A=3"})
+	mapping := func(name string) (string, bool) {
+		if name != "A" && name != "B" && name != "C" {
+			return "", false
+		}
+		return values(name)
+	}
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"${A}-${B}", "3-2"},
+		{"${C}", ""},
+		{"$A $$ $", "$A $$ $"},
+		{"$${A}", "${A}"},
+		{"$$${A}", "$${A}"},
+		{"${UNKNOWN} ${A", "${UNKNOWN} ${A"},
+		{"${}", "${}"},
+		{"${A:-x} ${1}", "${A:-x} ${1}"},
+		{"for f in a b; do echo ${f}; done", "for f in a b; do echo ${f}; done"},
+	} {
+		assert.Equal(t, tc.out, interpolate(tc.in, mapping), tc.in)
+	}
+}
+
+func TestCheckVariables(t *testing.T) {
+	defined := map[string]bool{"A": true}
+	assert.NoError(t, checkVariables("${A} $${B} $B", defined))
+	assert.EqualError(t, checkVariables("${B}", defined), `undefined variable "B"`)
+	for _, in := range []string{"${A", "${}", "${A:-x}"} {
+		assert.Error(t, checkVariables(in, defined), in)
+	}
+}
+
+func TestCommandVariables(t *testing.T) {
+	m := &Manifest{
+		Environment: []string{"GOPATH=${WORKSPACE}/go"},
+		Secrets:     map[string]string{"TOKEN": ""},
+		Matrix:      &Matrix{Env: map[string][]string{"GO": {"1.6"}}},
+	}
+	vars := m.commandVariables()
+	for _, name := range []string{"GOPATH", "TOKEN", "GO", "SEAEYE_SHA", "SEAEYE_TEST_RESULT", "PATH"} {
+		assert.True(t, vars[name], name)
+	}
+	assert.False(t, vars["DOCKER_PASSWORD"])
+}
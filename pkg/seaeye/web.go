@@ -3,17 +3,22 @@
 package seaeye
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/scraperwiki/seaeye/pkg/seaeye/ansi"
 )
 
 // Server is a http.Server that can gracefully shut down.
@@ -26,9 +31,12 @@ type Server struct {
 
 // ServerState provides a global context state for http.FuncHandler.
 type ServerState struct {
-	config *Config
-	builds chan *Build
-	stats  func() Stats
+	config      func() *Config
+	builds      *BuildQueue
+	secretKey   *SecretKey
+	secretStore *SecretStore
+	stats       func() Stats
+	ready       func() *Readiness
 }
 
 // StateHandlerFunc defines a http.FuncHandler with state.
@@ -41,23 +49,47 @@ type httpError struct {
 
 // NewWebServer initializes a new HTTP server. The difference to a standard
 // net.http server is that it knows about the listener and can stop itself
-// gracefully.
-func NewWebServer(conf *Config, builds chan *Build, stats func() Stats) *Server {
+// gracefully. Handlers get the current configuration from conf on every
+// request.
+func NewWebServer(conf func() *Config, builds *BuildQueue, secretKey *SecretKey, secretStore *SecretStore, stats func() Stats, ready func() *Readiness) *Server {
 	state := &ServerState{
-		config: conf,
-		builds: builds,
-		stats:  stats,
+		config:      conf,
+		builds:      builds,
+		secretKey:   secretKey,
+		secretStore: secretStore,
+		stats:       stats,
+		ready:       ready,
 	}
 
 	router := mux.NewRouter()
-	router.Path("/").Methods("GET").HandlerFunc(wrap(state, indexHandler))
-	router.Path("/health").Methods("GET").HandlerFunc(wrap(state, healthHandler))
-	router.Path("/jobs/{id}/status/{rev}").Methods("GET").HandlerFunc(wrap(state, statusJobHandler))
-	router.Path("/login").Methods("GET").HandlerFunc(wrap(state, loginHandler))
-	router.Path("/webhook").Methods("PUT", "POST").HandlerFunc(wrap(state, webhookHandler))
+	router.Path("/").Methods("GET").HandlerFunc(instrument("/", wrap(state, indexHandler)))
+	router.Path("/metrics").Methods("GET").HandlerFunc(instrument("/metrics", wrap(state, metricsHandler)))
+	router.Path("/health").Methods("GET").HandlerFunc(instrument("/health", wrap(state, healthHandler)))
+	router.Path("/healthz").Methods("GET").HandlerFunc(instrument("/healthz", wrap(state, livenessHandler)))
+	router.Path("/readyz").Methods("GET").HandlerFunc(instrument("/readyz", wrap(state, readinessHandler)))
+	router.Path("/jobs/{id}/status/{rev}").Methods("GET").HandlerFunc(instrument("/jobs/{id}/status/{rev}", wrapLogs(state, statusJobHandler)))
+	router.Path("/jobs/{id}/status/{rev}/{cell}").Methods("GET").HandlerFunc(instrument("/jobs/{id}/status/{rev}/{cell}", wrapLogs(state, statusJobHandler)))
+	router.Path("/search").Methods("GET").HandlerFunc(instrument("/search", wrapLogs(state, searchHandler)))
+	router.Path("/builds/{build:[0-9]+}/log.txt").Methods("GET").HandlerFunc(instrument("/builds/{build}/log.txt", wrapLogs(state, rawLogHandler)))
+	router.Path("/login").Methods("GET").HandlerFunc(instrument("/login", wrap(state, loginHandler)))
+	router.Path("/webhook").Methods("PUT", "POST").HandlerFunc(instrument("/webhook", wrap(state, webhookHandler)))
+
+	api := router.PathPrefix("/api").Subrouter()
+	api.Path("/builds").Methods("GET").HandlerFunc(instrument("/api/builds", wrapAPI(state, false, apiBuildsHandler)))
+	api.Path("/builds").Methods("POST").HandlerFunc(instrument("/api/builds", wrapAPI(state, true, apiTriggerHandler)))
+	api.Path("/builds/{build:[0-9]+}").Methods("GET").HandlerFunc(instrument("/api/builds/{build}", wrapAPI(state, false, apiBuildHandler)))
+	api.Path("/builds/{build:[0-9]+}/cancel").Methods("POST").HandlerFunc(instrument("/api/builds/{build}/cancel", wrapAPI(state, true, apiCancelHandler)))
+	api.Path("/builds/{build:[0-9]+}/log").Methods("GET").HandlerFunc(instrument("/api/builds/{build}/log", wrapAPI(state, false, apiBuildLogHandler)))
+	api.Path("/log/level").Methods("GET").HandlerFunc(instrument("/api/log/level", wrapAPI(state, true, apiLogLevelHandler)))
+	api.Path("/log/level").Methods("PUT").HandlerFunc(instrument("/api/log/level", wrapAPI(state, true, apiSetLogLevelHandler)))
+	api.Path("/search").Methods("GET").HandlerFunc(instrument("/api/search", wrapAPI(state, false, apiSearchHandler)))
+	api.Path("/key").Methods("GET").HandlerFunc(instrument("/api/key", wrapAPI(state, false, apiKeyHandler)))
+	api.Path("/secrets").Methods("GET").HandlerFunc(instrument("/api/secrets", wrapAPI(state, true, apiSecretsHandler)))
+	api.Path("/secrets/{name}").Methods("PUT").HandlerFunc(instrument("/api/secrets/{name}", wrapAPI(state, true, apiSetSecretHandler)))
+	api.Path("/secrets/{name}").Methods("DELETE").HandlerFunc(instrument("/api/secrets/{name}", wrapAPI(state, true, apiDeleteSecretHandler)))
 
 	srv := &Server{}
-	srv.Addr = conf.HostPort
+	srv.Addr = conf().HostPort
 	srv.ConnState = srv.connStateHook()
 	srv.Handler = router
 
@@ -73,7 +105,7 @@ func (srv *Server) Start() error {
 	srv.Listener = ln
 
 	go func() {
-		log.Printf("[E][web] Socket closed: %v", srv.Serve(ln))
+		webLog.Errorf("Socket closed: %v", srv.Serve(ln))
 	}()
 
 	return nil
@@ -120,6 +152,54 @@ func wrap(state *ServerState, handler StateHandlerFunc) http.HandlerFunc {
 	}
 }
 
+// wrapLogs requires the API token for pages showing build logs, like the API
+// does, if one is configured. Browsers are asked for it as password.
+func wrapLogs(state *ServerState, handler StateHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(state.config().APIToken, req) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="seaeye"`)
+			http.Error(w, "invalid API token", http.StatusUnauthorized)
+			return
+		}
+		handler(state, w, req)
+	}
+}
+
+// instrument records the number and duration of requests to a route.
+func instrument(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, req)
+		metricHTTPRequests.Inc(route, req.Method, strconv.Itoa(sw.status))
+		metricHTTPDuration.Observe(time.Since(start).Seconds(), route, req.Method)
+	}
+}
+
+// statusWriter records the status code written to a http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (w *statusWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
 func indexHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
 	// TODO(uwe): implement
 }
@@ -131,6 +211,36 @@ func healthHandler(state *ServerState, w http.ResponseWriter, req *http.Request)
 	}
 }
 
+// livenessHandler reports that the server is serving requests.
+func livenessHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	stats := state.stats()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "ok",
+		"uptime":  stats["/app/uptime"].(time.Duration).Seconds(),
+		"version": stats["/app/version"],
+	})
+}
+
+// readinessHandler reports if the server is ready to run builds, failing with
+// 503 Service Unavailable if any check failed.
+func readinessHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	r := state.ready()
+	status := http.StatusOK
+	if !r.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, r)
+}
+
+func metricsHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "seaeye_queue_depth", "gauge", "Number of pending builds.", float64(state.builds.Len()))
+	writeMetric(w, "seaeye_builds_running", "gauge", "Number of running builds.", float64(state.builds.Running()))
+	if _, err := metrics.WriteTo(w); err != nil {
+		webLog.Errorf("Failed to write metrics: %v", err)
+	}
+}
+
 func loginHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
 	// TODO(uwe): implement
 }
@@ -138,24 +248,44 @@ func loginHandler(state *ServerState, w http.ResponseWriter, req *http.Request)
 func webhookHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
 	s, err := sourceFromRequest(req)
 	if err != nil {
-		log.Printf("[E][web] Invalid github webhook push event: %v", err)
+		webLog.Errorf("Invalid github webhook push event: %v", err)
 		msg, code := toHTTPError(err)
 		http.Error(w, msg, code)
 		return
 	}
 
-	log.Printf("[I][web] Enqueuing job: %#v", s)
-	j := &Job{Config: state.config}
-	state.builds <- &Build{Job: j, Source: s}
-	log.Printf("[I][web] Enqueued job")
+	if !state.config().Allowed(s) {
+		webLog.With(sourceFields(s)...).Infof("Ignoring job not allowlisted: %#v", s)
+		fmt.Fprintln(w, "Ignored: not allowlisted")
+		return
+	}
+
+	webLog.With(sourceFields(s)...).Infof("Enqueuing job: %#v", s)
+	j := &Job{Config: state.config(), SecretKey: state.secretKey, SecretStore: state.secretStore}
+	b, err := state.builds.Enqueue(j, s)
+	if err != nil {
+		webLog.With(sourceFields(s)...).Errorf("Failed to enqueue job: %v", err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	buildLog(webLog, b).Infof("Enqueued job: build %d", b.ID)
 }
 
 func statusJobHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	id := vars["id"]
 	rev := vars["rev"]
-
-	logFilePath, err := state.config.LogFilePath(id, rev)
+	cell := vars["cell"]
+
+	var logFilePath string
+	var err error
+	if cell == "" {
+		logFilePath, err = state.config().LogFilePath(id, rev)
+	} else {
+		logFilePath, err = state.config().CellLogFilePath(id, rev, cell)
+		rev += " " + cell
+	}
 	if err != nil {
 		msg, code := toHTTPError(err)
 		http.Error(w, msg, code)
@@ -164,29 +294,167 @@ func statusJobHandler(state *ServerState, w http.ResponseWriter, req *http.Reque
 
 	// TODO(uwe): Stream output
 
-	b, err := ioutil.ReadFile(logFilePath)
+	if parseBool(req.FormValue("download")) {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", escapePath(id+"-"+rev)+".txt"))
+		serveLogFile(w, req, logFilePath)
+		return
+	}
+
+	b, err := readLogFile(logFilePath)
 	if err != nil {
 		msg, code := toHTTPError(err)
 		http.Error(w, msg, code)
 		return
 	}
 
+	// Logs written before framing was introduced have no frames.
+	frames, err := ReadFrames(logFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		webLog.Errorf("Failed to read log frames: %v", err)
+	}
+
+	page, _ := strconv.Atoi(req.FormValue("page"))
 	w.Header().Set("Content-type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, `<!doctype html>
-<html style="color: #dddddd; background-color: #272821;">
-<head>
-  <meta charset="utf-8">
-  <title>%s %s</title>
-<body>
-<pre>`, id, rev)
-	// NOTE(uwe): Don't convert to ansi for now due to maybe memory issues.
-	// w.Write(ansi.ToHTML(b))
-	w.Write(b)
-	fmt.Fprintf(w, `
-</pre>
-</body>
-</html>
-`)
+	if err := writeLogPage(w, id+" "+rev, b, frames, page); err != nil {
+		webLog.Errorf("Failed to write log page: %v", err)
+	}
+}
+
+// serveLogFile serves a log file as plain text. A compressed log is served as
+// is with Content-Encoding gzip if the client accepts it, or else decompressed.
+func serveLogFile(w http.ResponseWriter, req *http.Request, logFilePath string) {
+	f, compressed, err := openLogFile(logFilePath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Add("Vary", "Accept-Encoding")
+	var r io.Reader = f
+	if compressed {
+		if acceptsGzip(req) {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else if r, err = gzip.NewReader(f); err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+	}
+	io.Copy(w, r)
+}
+
+// rawLogHandler serves the log of a recent or recorded build, or with `cell`
+// set of one of its matrix cells, as plain text, supporting Range,
+// If-None-Match, and If-Modified-Since requests. With `strip` set, ANSI escape
+// sequences are removed, with `download` set, the log is served as attachment.
+func rawLogHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	b, err := buildFromRequest(state, req)
+	if err == ErrBuildNotFound {
+		id, _ := strconv.Atoi(mux.Vars(req)["build"])
+		b, err = savedBuild(state.config(), id)
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	c := state.config()
+	name := escapePath(path.Join(b.Source.Owner, b.Source.Repo)) + "-" + escapePath(b.Source.Rev)
+	var logFilePath string
+	if cell := req.FormValue("cell"); cell != "" {
+		logFilePath, err = c.CellLogFilePath(escapePath(path.Join(b.Source.Owner, b.Source.Repo)), b.Source.Rev, cell)
+		name += "-" + escapePath(cell)
+	} else {
+		logFilePath, err = b.LogFilePath(c)
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	f, compressed, err := openLogFile(logFilePath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	strip := parseBool(req.FormValue("strip"))
+	etag := fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size())
+	if strip {
+		etag += "-strip"
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	if notModified(req, etag, fi.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Range requests need the log as is, so compressed and stripped logs are
+	// served from memory.
+	var content io.ReadSeeker = f
+	if compressed || strip {
+		var r io.Reader = f
+		if compressed {
+			if r, err = gzip.NewReader(f); err != nil {
+				msg, code := toHTTPError(err)
+				http.Error(w, msg, code)
+				return
+			}
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		if strip {
+			data = ansi.Strip(data)
+		}
+		content = bytes.NewReader(data)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if parseBool(req.FormValue("download")) {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".txt"))
+	}
+	http.ServeContent(w, req, "log.txt", fi.ModTime(), content)
+}
+
+// notModified decides if the client's copy of a log with etag and modtime is
+// current, checked before reading the log.
+func notModified(req *http.Request, etag string, modtime time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == `"`+etag+`"` {
+				return true
+			}
+		}
+		return false
+	}
+	t, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	return err == nil && !modtime.Truncate(time.Second).After(t)
+}
+
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
 }
 
 func sourceFromRequest(req *http.Request) (*Source, error) {
@@ -214,6 +482,15 @@ func sourceFromRequest(req *http.Request) (*Source, error) {
 		Rev:   *e.After,
 		URL:   *e.Repo.URL,
 	}
+	if e.Ref != nil {
+		s.Ref = *e.Ref
+	}
+	if e.Pusher != nil && e.Pusher.Name != nil {
+		s.Pusher = *e.Pusher.Name
+	}
+	if e.Repo.Fork != nil {
+		s.Fork = *e.Repo.Fork
+	}
 	return s, nil
 }
 
@@ -221,6 +498,14 @@ func toHTTPError(err error) (msg string, httpStatus int) {
 	if httpErr, ok := err.(*httpError); ok {
 		return httpErr.Error(), httpErr.Status
 	}
+	switch err {
+	case ErrBuildNotFound, ErrSecretNotFound:
+		return err.Error(), http.StatusNotFound
+	case ErrBuildFinished:
+		return err.Error(), http.StatusConflict
+	case ErrQueueFull, ErrShuttingDown:
+		return err.Error(), http.StatusServiceUnavailable
+	}
 	if os.IsNotExist(err) {
 		return fmt.Sprintf("%d %s", http.StatusNotFound,
 			http.StatusText(http.StatusNotFound)), http.StatusNotFound
@@ -0,0 +1,417 @@
+package seaeye
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// LogEntry specifies a chunk of a build log for API responses, see LogFrame.
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Stream  string    `json:"stream"`
+	Stage   string    `json:"stage,omitempty"`
+	Command int       `json:"command,omitempty"`
+	Text    string    `json:"text"`
+}
+
+// TriggerRequest specifies the body of a build trigger API request.
+type TriggerRequest struct {
+	Repo string `json:"repo"` // e.g. scraperwiki/seaeye
+	Ref  string `json:"ref"`  // e.g. master, refs/heads/master, or a commit
+}
+
+// wrapAPI wraps an API handler, requiring the configured API token. Requests
+// changing state are refused without configured token.
+func wrapAPI(state *ServerState, write bool, handler StateHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := state.config().APIToken
+		if token == "" && write {
+			writeJSONError(w, &httpError{error: fmt.Errorf("no API token configured"), Status: http.StatusForbidden})
+			return
+		}
+		if !authorized(token, req) {
+			writeJSONError(w, &httpError{error: fmt.Errorf("invalid API token"), Status: http.StatusUnauthorized})
+			return
+		}
+		handler(state, w, req)
+	}
+}
+
+// authorized decides if req carries the API token, as bearer token or, from
+// browsers, as password of basic authentication. Without a token, every request
+// is authorized.
+func authorized(token string, req *http.Request) bool {
+	if token == "" {
+		return true
+	}
+	if _, password, ok := req.BasicAuth(); ok {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(token)) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+func apiBuildsHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, state.builds.List())
+}
+
+func apiBuildHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	b, err := buildFromRequest(state, req)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state.builds.Info(b))
+}
+
+func apiTriggerHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	var t TriggerRequest
+	if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+		writeJSONError(w, &httpError{error: fmt.Errorf("invalid request: %v", err), Status: http.StatusBadRequest})
+		return
+	}
+	parts := strings.Split(t.Repo, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || t.Ref == "" {
+		writeJSONError(w, &httpError{error: fmt.Errorf("invalid repo %q or ref %q", t.Repo, t.Ref), Status: http.StatusBadRequest})
+		return
+	}
+
+	url := fmt.Sprintf("git@github.com:%s.git", t.Repo)
+	rev, ref, err := ResolveRef(url, t.Ref)
+	if err != nil {
+		writeJSONError(w, &httpError{error: err, Status: http.StatusBadRequest})
+		return
+	}
+
+	s := &Source{Owner: parts[0], Repo: parts[1], Rev: rev, URL: url, Ref: ref}
+	if !state.config().Allowed(s) {
+		writeJSONError(w, &httpError{error: fmt.Errorf("%s %s is not allowlisted", t.Repo, t.Ref), Status: http.StatusForbidden})
+		return
+	}
+
+	webLog.With(sourceFields(s)...).Infof("Enqueuing triggered job: %#v", s)
+	b, err := state.builds.Enqueue(&Job{Config: state.config(), SecretKey: state.secretKey, SecretStore: state.secretStore}, s)
+	if err != nil {
+		webLog.With(sourceFields(s)...).Errorf("Failed to enqueue job: %v", err)
+		writeJSONError(w, err)
+		return
+	}
+	buildLog(webLog, b).Infof("Enqueued job: build %d", b.ID)
+	writeJSON(w, http.StatusCreated, state.builds.Info(b))
+}
+
+func apiCancelHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	b, err := buildFromRequest(state, req)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	buildLog(webLog, b).Infof("Canceling build %d", b.ID)
+	if _, err := state.builds.Cancel(b.ID); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state.builds.Info(b))
+}
+
+// apiBuildLogHandler serves a build's log. With `follow` set, the log is
+// streamed until the build finished. With `format=json`, the log is served as
+// LogEntry objects, one per line. With `stream` set, only the chunks of that
+// stream are served, e.g. stderr.
+func apiBuildLogHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	b, err := buildFromRequest(state, req)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	follow := parseBool(req.FormValue("follow"))
+
+	logFilePath, err := b.LogFilePath(state.config())
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	var closeCh <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closeCh = cn.CloseNotify()
+	}
+	wait := func() bool {
+		select {
+		case <-closeCh:
+			return false
+		case <-time.After(500 * time.Millisecond):
+			return true
+		}
+	}
+
+	// A queued build's log file doesn't exist yet, or is from a previous build.
+	for follow && state.builds.Info(b).State == BuildQueued {
+		if !wait() {
+			return
+		}
+	}
+
+	format, stream := req.FormValue("format"), req.FormValue("stream")
+	f, compressed, err := openLogFile(logFilePath)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	defer f.Close()
+	if compressed {
+		serveCompressedLog(w, req, logFilePath, format == "json", stream)
+		return
+	}
+
+	copyLog := func() error {
+		_, err := io.Copy(w, f)
+		return err
+	}
+	if format == "json" || stream != "" {
+		framesFile, err := os.Open(FramesFilePath(logFilePath))
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		defer framesFile.Close()
+		fr := newFrameReader(framesFile)
+		copyLog = func() error {
+			frames, err := fr.read()
+			if err != nil {
+				return err
+			}
+			return writeLogEntries(w, f, frames, format == "json", stream)
+		}
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	for {
+		finished := state.builds.Finished(b)
+		if err := copyLog(); err != nil {
+			return
+		}
+		if !follow || finished {
+			return
+		}
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+		if !wait() {
+			return
+		}
+	}
+}
+
+// serveCompressedLog serves the log of a finished build compressed by the
+// janitor, like apiBuildLogHandler does.
+func serveCompressedLog(w http.ResponseWriter, req *http.Request, logFilePath string, asJSON bool, stream string) {
+	if !asJSON && stream == "" {
+		serveLogFile(w, req, logFilePath)
+		return
+	}
+	b, err := readLogFile(logFilePath)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	frames, err := ReadFrames(logFilePath)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if asJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	writeLogEntries(w, bytes.NewReader(b), frames, asJSON, stream)
+}
+
+// writeLogEntries writes the chunks of a log, of a single stream if given, as
+// LogEntry objects or as plain text.
+func writeLogEntries(w io.Writer, r io.ReaderAt, frames []LogFrame, asJSON bool, stream string) error {
+	enc := json.NewEncoder(w)
+	for _, f := range frames {
+		if stream != "" && f.Stream != stream {
+			continue
+		}
+		b := make([]byte, f.Length)
+		if _, err := r.ReadAt(b, f.Offset); err != nil {
+			return err
+		}
+		var err error
+		if asJSON {
+			err = enc.Encode(LogEntry{Time: f.Time, Stream: f.Stream, Stage: f.Stage, Command: f.Command, Text: string(b)})
+		} else {
+			_, err = w.Write(b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiSearchHandler searches build logs, see Search and searchQueryFromRequest.
+func apiSearchHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	q, err := searchQueryFromRequest(req)
+	if err == nil && strings.TrimSpace(q.Text) == "" {
+		err = &httpError{error: fmt.Errorf("missing search text q"), Status: http.StatusBadRequest}
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	results, err := Search(state.config(), q)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// apiKeyHandler returns the public key to encrypt manifest secrets with.
+func apiKeyHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	if state.secretKey == nil {
+		writeJSONError(w, &httpError{error: fmt.Errorf("no secret key configured"), Status: http.StatusNotFound})
+		return
+	}
+	b, err := state.secretKey.PublicKeyPEM()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(b)
+}
+
+// SecretRequest specifies a secret's value to store.
+type SecretRequest struct {
+	Value string `json:"value"`
+}
+
+// apiSecretsHandler lists the secrets of the scope given as query parameter,
+// or of all scopes.
+func apiSecretsHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	store, err := secretStore(state)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	scope := "*"
+	if scopes, ok := req.URL.Query()["scope"]; ok {
+		scope = scopes[0]
+	}
+	infos := store.List(scope)
+	if infos == nil {
+		infos = []*SecretInfo{}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func apiSetSecretHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	store, err := secretStore(state)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	var r SecretRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeJSONError(w, &httpError{error: fmt.Errorf("invalid request: %v", err), Status: http.StatusBadRequest})
+		return
+	}
+
+	scope, name := req.URL.Query().Get("scope"), mux.Vars(req)["name"]
+	info, err := store.Set(scope, name, r.Value)
+	if err != nil {
+		writeJSONError(w, &httpError{error: err, Status: http.StatusBadRequest})
+		return
+	}
+	webLog.Infof("Set secret %s in scope %q", name, scope)
+	writeJSON(w, http.StatusOK, info)
+}
+
+func apiDeleteSecretHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	store, err := secretStore(state)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	scope, name := req.URL.Query().Get("scope"), mux.Vars(req)["name"]
+	if err := store.Delete(scope, name); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	webLog.Infof("Deleted secret %s in scope %q", name, scope)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogLevelRequest specifies the body of a log level API request and response.
+type LogLevelRequest struct {
+	Level string `json:"level"` // debug, info, warn, or error
+}
+
+func apiLogLevelHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, LogLevelRequest{Level: ServerLog.Level().String()})
+}
+
+// apiSetLogLevelHandler sets the server log level until the next restart or
+// change of the configured level.
+func apiSetLogLevelHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	var r LogLevelRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeJSONError(w, &httpError{error: fmt.Errorf("invalid request: %v", err), Status: http.StatusBadRequest})
+		return
+	}
+	level, err := ParseLogLevel(r.Level)
+	if err != nil {
+		writeJSONError(w, &httpError{error: err, Status: http.StatusBadRequest})
+		return
+	}
+	ServerLog.SetLevel(level)
+	webLog.Infof("Set log level: %s", level)
+	writeJSON(w, http.StatusOK, LogLevelRequest{Level: level.String()})
+}
+
+func secretStore(state *ServerState) (*SecretStore, error) {
+	if state.secretStore == nil {
+		return nil, &httpError{error: fmt.Errorf("no secret store configured"), Status: http.StatusNotFound}
+	}
+	return state.secretStore, nil
+}
+
+func buildFromRequest(state *ServerState, req *http.Request) (*Build, error) {
+	id, err := strconv.Atoi(mux.Vars(req)["build"])
+	if err != nil {
+		return nil, &httpError{error: fmt.Errorf("invalid build id: %v", err), Status: http.StatusBadRequest}
+	}
+	return state.builds.Get(id)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		webLog.Errorf("Failed to write response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, err error) {
+	msg, code := toHTTPError(err)
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,266 @@
+package seaeye
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logSection groups the consecutive frames of a stage, or of a command within
+// a stage.
+type logSection struct {
+	Name     string
+	Elapsed  string
+	Open     bool
+	Stderr   bool // has stderr output
+	Lines    []logLine
+	Commands []*logSection
+	After    []logLine // stage messages following the commands
+	start    time.Time
+	end      time.Time
+}
+
+// logLine is a chunk of a build log. Chunks starting a line carry the time
+// elapsed since the start of the build, and the line's 1-based number.
+type logLine struct {
+	Line   int
+	Time   string
+	Stream string
+	Text   string
+}
+
+// logPageSize holds the size of the part of a log shown per page.
+const logPageSize = 1 << 20
+
+// logSections groups a framed build log into stage sections holding the
+// stage's own messages around a section per command. The last command section,
+// e.g. the one that failed, is open.
+func logSections(b []byte, frames []LogFrame) []*logSection {
+	if len(frames) == 0 {
+		return nil
+	}
+	return logSectionsAt(b, frames, frames[0].Time, 1)
+}
+
+// logSectionsAt groups frames like logSections does, for a page of a log
+// starting at line n with times relative to buildStart.
+func logSectionsAt(b []byte, frames []LogFrame, buildStart time.Time, n int) []*logSection {
+	if len(frames) == 0 {
+		return nil
+	}
+
+	var stages []*logSection
+	var stage, command *logSection
+	atLineStart := true
+	n-- // lines started
+	for i, f := range frames {
+		if stage == nil || f.Stage != frames[i-1].Stage {
+			stage = &logSection{Name: f.Stage, Open: true, start: f.Time}
+			if stage.Name == "" {
+				stage.Name = "Setup"
+			}
+			stages = append(stages, stage)
+			command = nil
+		}
+		if f.Command > 0 && (command == nil || f.Command != frames[i-1].Command) {
+			command = &logSection{Name: fmt.Sprintf("Command %d", f.Command), start: f.Time}
+			stage.Commands = append(stage.Commands, command)
+		}
+		section, lines := stage, &stage.Lines
+		if f.Command > 0 {
+			section, lines = command, &command.Lines
+		} else if len(stage.Commands) > 0 {
+			lines = &stage.After
+		}
+		stage.end, section.end = f.Time, f.Time
+		if f.Stream == StreamStderr {
+			stage.Stderr, section.Stderr = true, true
+		}
+
+		start, end := f.Offset, f.Offset+int64(f.Length)
+		if start > int64(len(b)) {
+			break
+		}
+		if end > int64(len(b)) {
+			end = int64(len(b))
+		}
+		for _, text := range bytes.SplitAfter(b[start:end], []byte("\n")) {
+			if len(text) == 0 {
+				continue
+			}
+			line := logLine{Stream: f.Stream, Text: string(text)}
+			if atLineStart {
+				n++
+				line.Line = n
+				line.Time = formatElapsed(f.Time.Sub(buildStart))
+			}
+			*lines = append(*lines, line)
+			atLineStart = text[len(text)-1] == '\n'
+		}
+	}
+
+	// Sections last until the next one starts.
+	for i, s := range stages {
+		if i+1 < len(stages) {
+			s.end = stages[i+1].start
+		}
+		for j, c := range s.Commands {
+			if j+1 < len(s.Commands) {
+				c.end = s.Commands[j+1].start
+			}
+			c.Elapsed = formatElapsed(c.end.Sub(c.start))
+		}
+		s.Elapsed = formatElapsed(s.end.Sub(s.start))
+	}
+	if last := stages[len(stages)-1]; len(last.Commands) > 0 {
+		last.Commands[len(last.Commands)-1].Open = true
+	}
+	return stages
+}
+
+// formatElapsed formats a duration as minutes and seconds, e.g. "02:05.3".
+func formatElapsed(d time.Duration) string {
+	return fmt.Sprintf("%02d:%04.1f", int(d.Minutes()), (d % time.Minute).Seconds())
+}
+
+var logPageTemplate = template.Must(template.New("log").Parse(`<!doctype html>
+<html style="color: #dddddd; background-color: #272821;">
+<head>
+  <meta charset="utf-8">
+  <title>{{.Title}}</title>
+  <style>
+    a { color: #66d9ef; }
+    details { margin-left: 1em; }
+    summary { cursor: pointer; }
+    pre { margin: 0; }
+    .elapsed { color: #75715e; }
+    .stderr { color: #f92672; }
+    .time { color: #75715e; -moz-user-select: none; -webkit-user-select: none; user-select: none; }
+    :target, :target + span { background-color: #49483e; }
+  </style>
+<body data-page="{{.Page}}" data-page-lines="{{.PageLines}}">
+{{define "pager"}}{{if gt .Pages 1}}<p>Page {{.Page}} of {{.Pages}}{{if gt .Page 1}} <a href="?page=1">First</a> <a href="?page={{.Prev}}">Previous</a>{{end}}{{if lt .Page .Pages}} <a href="?page={{.Next}}">Next</a> <a href="?page={{.Pages}}">Last</a>{{end}}</p>{{end}}{{end -}}
+<p>{{.Title}} <a href="?download=1">Download</a></p>
+{{template "pager" .}}
+{{define "lines"}}{{if .}}<pre>{{range .}}{{if .Time}}<span class="time" id="L{{.Line}}">{{.Time}} </span>{{else if .Line}}<span id="L{{.Line}}"></span>{{end}}<span class="{{.Stream}}">{{.Text}}</span>{{end}}</pre>{{end}}{{end -}}
+{{range .Sections}}<details{{if .Open}} open{{end}}>
+<summary>{{.Name}} <span class="elapsed">{{.Elapsed}}</span>{{if .Stderr}} <span class="stderr">stderr</span>{{end}}</summary>
+{{template "lines" .Lines}}
+{{range .Commands}}<details{{if .Open}} open{{end}}>
+<summary>{{.Name}} <span class="elapsed">{{.Elapsed}}</span>{{if .Stderr}} <span class="stderr">stderr</span>{{end}}</summary>
+{{template "lines" .Lines}}
+</details>
+{{end}}{{template "lines" .After}}
+</details>
+{{else}}{{template "lines" .Lines}}
+{{end}}{{template "pager" .}}
+<script>
+// Open the sections holding the line linked to, e.g. by a search result, or
+// go to the page holding it.
+function showTarget() {
+  var id = location.hash.slice(1), e = id && document.getElementById(id);
+  if (!e && /^L[0-9]+$/.test(id)) {
+    var n = parseInt(id.slice(1), 10), lines = document.body.getAttribute("data-page-lines").split(","), page = 1;
+    for (var i = 1; i < lines.length; i++) {
+      if (n >= parseInt(lines[i], 10)) page = i + 1;
+    }
+    if (page != document.body.getAttribute("data-page")) location.replace("?page=" + page + location.hash);
+    return;
+  }
+  for (var p = e; p; p = p.parentElement) {
+    if (p.tagName == "DETAILS") p.open = true;
+  }
+  if (e) e.scrollIntoView();
+}
+window.addEventListener("hashchange", showTarget);
+showTarget();
+</script>
+</body>
+</html>
+`))
+
+// logPages returns the offsets of the pages of a log, each starting at the
+// first line after logPageSize bytes of the previous one.
+func logPages(b []byte) []int {
+	pages := []int{0}
+	for start := 0; len(b)-start > logPageSize; {
+		i := bytes.IndexByte(b[start+logPageSize:], '\n')
+		if i < 0 || start+logPageSize+i+1 == len(b) {
+			break
+		}
+		start += logPageSize + i + 1
+		pages = append(pages, start)
+	}
+	return pages
+}
+
+// clipFrames returns the frames, or their parts, within [start, end) of a
+// log.
+func clipFrames(frames []LogFrame, start, end int64) []LogFrame {
+	var clipped []LogFrame
+	for _, f := range frames {
+		fs, fe := f.Offset, f.Offset+int64(f.Length)
+		if fe <= start || fs >= end {
+			continue
+		}
+		if fs < start {
+			fs = start
+		}
+		if fe > end {
+			fe = end
+		}
+		f.Offset, f.Length = fs, int(fe-fs)
+		clipped = append(clipped, f)
+	}
+	return clipped
+}
+
+// writeLogPage writes a page of a build log, 1-based or 0 for the last, as
+// HTML page, with collapsible sections if the log is framed. Lines are linked
+// as #L{number}, also from other pages.
+func writeLogPage(w io.Writer, title string, b []byte, frames []LogFrame, page int) error {
+	pages := logPages(b)
+	if page <= 0 || page > len(pages) {
+		page = len(pages)
+	}
+	start, end := pages[page-1], len(b)
+	if page < len(pages) {
+		end = pages[page]
+	}
+	pageLines := make([]string, len(pages))
+	n := 1
+	for i, p := range pages {
+		if i > 0 {
+			n += bytes.Count(b[pages[i-1]:p], []byte("\n"))
+		}
+		pageLines[i] = strconv.Itoa(n)
+	}
+	first, _ := strconv.Atoi(pageLines[page-1])
+
+	var sections []*logSection
+	if len(frames) > 0 {
+		sections = logSectionsAt(b, clipFrames(frames, int64(start), int64(end)), frames[0].Time, first)
+	}
+	var lines []logLine
+	if sections == nil {
+		for i, text := range bytes.SplitAfter(b[start:end], []byte("\n")) {
+			if len(text) > 0 {
+				lines = append(lines, logLine{Line: first + i, Text: string(text)})
+			}
+		}
+	}
+	return logPageTemplate.Execute(w, map[string]interface{}{
+		"Title":     title,
+		"Lines":     lines,
+		"Sections":  sections,
+		"Page":      page,
+		"Pages":     len(pages),
+		"PageLines": strings.Join(pageLines, ","),
+		"Prev":      page - 1,
+		"Next":      page + 1,
+	})
+}
@@ -0,0 +1,103 @@
+package seaeye
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogSections(t *testing.T) {
+	var log, framesBuf bytes.Buffer
+	f := newFrameWriter(&log, &framesBuf)
+	fmt.Fprint(f.stream(StreamLog), "setup\n")
+	f.setSection("Test", 0)
+	fmt.Fprint(f.stream(StreamLog), "Test started\n")
+	f.setSection("Test", 1)
+	fmt.Fprint(f.stream(StreamStdout), "ok 1")
+	fmt.Fprint(f.stream(StreamStdout), " done\nok 2\n")
+	f.setSection("Test", 0)
+	fmt.Fprint(f.stream(StreamLog), "Test finished\n")
+
+	var frames []LogFrame
+	dec := json.NewDecoder(&framesBuf)
+	for dec.More() {
+		var frame LogFrame
+		assert.NoError(t, dec.Decode(&frame))
+		frames = append(frames, frame)
+	}
+	assert.Len(t, frames, 5)
+	assert.Equal(t, LogFrame{Time: frames[3].Time, Stream: StreamStdout, Stage: "Test", Command: 1, Offset: 23, Length: 11}, frames[3])
+
+	sections := logSections(log.Bytes(), frames)
+	if !assert.Len(t, sections, 2) {
+		return
+	}
+	assert.Equal(t, "Setup", sections[0].Name)
+	test := sections[1]
+	assert.Equal(t, "Test", test.Name)
+	assert.Equal(t, "Test started\n", test.Lines[0].Text)
+	assert.Equal(t, "Test finished\n", test.After[0].Text)
+	if !assert.Len(t, test.Commands, 1) {
+		return
+	}
+	lines := test.Commands[0].Lines
+	assert.Equal(t, []string{"ok 1", " done\n", "ok 2\n"}, []string{lines[0].Text, lines[1].Text, lines[2].Text})
+	assert.NotEmpty(t, lines[0].Time)
+	assert.Empty(t, lines[1].Time)
+	assert.NotEmpty(t, lines[2].Time)
+	assert.True(t, test.Commands[0].Open)
+}
+
+func TestWriteLogPage(t *testing.T) {
+	var log bytes.Buffer
+	for i := 1; log.Len() < 2*logPageSize+100; i++ {
+		fmt.Fprintf(&log, "line %d\n", i)
+	}
+	pages := logPages(log.Bytes())
+	if !assert.Len(t, pages, 3) {
+		return
+	}
+	second := bytes.Count(log.Bytes()[:pages[1]], []byte("\n")) + 1
+	assert.True(t, bytes.HasPrefix(log.Bytes()[pages[1]:], []byte(fmt.Sprintf("line %d\n", second))))
+
+	var page bytes.Buffer
+	assert.NoError(t, writeLogPage(&page, "test", log.Bytes(), nil, 2))
+	assert.Contains(t, page.String(), fmt.Sprintf(`data-page-lines="1,%d,`, second))
+	assert.Contains(t, page.String(), fmt.Sprintf(`<span id="L%d"></span><span class="">line %d`, second, second))
+	assert.NotContains(t, page.String(), `id="L1"`)
+	assert.Contains(t, page.String(), "Page 2 of 3")
+
+	frames := []LogFrame{{Offset: 0, Length: 10}, {Offset: 10, Length: 10}, {Offset: 20, Length: 10}}
+	assert.Equal(t, []LogFrame{{Offset: 15, Length: 5}, {Offset: 20, Length: 5}}, clipFrames(frames, 15, 25))
+}
+
+func TestWrapLogs(t *testing.T) {
+	c := &Config{}
+	state := &ServerState{config: func() *Config { return c }}
+	h := wrapLogs(state, func(state *ServerState, w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "log")
+	})
+	get := func(auth func(req *http.Request)) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/builds/1/log.txt", nil)
+		auth(req)
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+	none := func(req *http.Request) {}
+
+	assert.Equal(t, http.StatusOK, get(none).Code, "no token configured")
+
+	c.APIToken = "s3cr3t"
+	w := get(none)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="seaeye"`, w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, get(func(req *http.Request) { req.SetBasicAuth("", "wrong") }).Code)
+	assert.Equal(t, http.StatusOK, get(func(req *http.Request) { req.SetBasicAuth("", "s3cr3t") }).Code)
+	assert.Equal(t, http.StatusOK, get(func(req *http.Request) { req.Header.Set("Authorization", "Bearer s3cr3t") }).Code)
+}
@@ -0,0 +1,142 @@
+package seaeye
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchStates lists the build states to filter searches by.
+var searchStates = []string{"success", "failure", "error", BuildCanceled}
+
+// searchQueryFromRequest parses the query parameters of a search: q, repo,
+// branch, state, since and until (RFC 3339 or dates, until inclusive), and
+// limit.
+func searchQueryFromRequest(req *http.Request) (*SearchQuery, error) {
+	q := &SearchQuery{
+		Text:   req.FormValue("q"),
+		Repo:   req.FormValue("repo"),
+		Branch: req.FormValue("branch"),
+		State:  req.FormValue("state"),
+	}
+	if q.State != "" && !containsString(searchStates, q.State) {
+		return nil, &httpError{error: fmt.Errorf("invalid state %q", q.State), Status: http.StatusBadRequest}
+	}
+	var err error
+	if q.Since, err = parseSearchTime(req.FormValue("since"), false); err != nil {
+		return nil, err
+	}
+	if q.Until, err = parseSearchTime(req.FormValue("until"), true); err != nil {
+		return nil, err
+	}
+	if s := req.FormValue("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return nil, &httpError{error: fmt.Errorf("invalid limit %q", s), Status: http.StatusBadRequest}
+		}
+	}
+	return q, nil
+}
+
+// parseSearchTime parses a time or a date, which as end of a range includes
+// the whole day.
+func parseSearchTime(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, &httpError{error: fmt.Errorf("invalid time %q, expected e.g. 2006-01-02", s), Status: http.StatusBadRequest}
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// textPart is a part of a search match, highlighted or not.
+type textPart struct {
+	Text string
+	Mark bool
+}
+
+// highlight splits a search match into its highlighted and other parts.
+func highlight(m SearchMatch) []textPart {
+	var parts []textPart
+	i := 0
+	for _, h := range m.Highlights {
+		if h[0] > i {
+			parts = append(parts, textPart{Text: m.Text[i:h[0]]})
+		}
+		parts = append(parts, textPart{Text: m.Text[h[0]:h[1]], Mark: true})
+		i = h[1]
+	}
+	if i < len(m.Text) {
+		parts = append(parts, textPart{Text: m.Text[i:]})
+	}
+	return parts
+}
+
+var searchPageTemplate = template.Must(template.New("search").Funcs(template.FuncMap{"highlight": highlight}).Parse(`<!doctype html>
+<html style="color: #dddddd; background-color: #272821;">
+<head>
+  <meta charset="utf-8">
+  <title>{{with .Query.Text}}{{.}} - {{end}}Search</title>
+  <style>
+    a { color: #66d9ef; }
+    input, select { color: #dddddd; background-color: #3e3d32; border: 1px solid #75715e; }
+    mark { color: #272821; background-color: #e6db74; }
+    pre { margin: 0 0 0 1em; }
+    .error { color: #f92672; }
+    .info { color: #75715e; }
+  </style>
+<body>
+<form action="" method="get">
+  <input name="q" value="{{.Query.Text}}" placeholder="Search logs" size="40" autofocus>
+  <input name="repo" value="{{.Query.Repo}}" placeholder="owner/repo">
+  <input name="branch" value="{{.Query.Branch}}" placeholder="branch">
+  <select name="state"><option value="">any state</option>{{range .States}}<option{{if eq . $.Query.State}} selected{{end}}>{{.}}</option>{{end}}</select>
+  <input name="since" value="{{.Since}}" placeholder="since 2006-01-02">
+  <input name="until" value="{{.Until}}" placeholder="until 2006-01-02">
+  <button>Search</button>
+</form>
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+{{range .Results}}<p><a href="{{.URL}}">{{.Job}} {{.Rev}}{{with .Cell}} {{.}}{{end}}</a>
+<span class="info">{{with .Build}}{{.State}} {{.Ref}} {{end}}{{.Time.Format "2006-01-02 15:04"}}, {{.Count}} matching line{{if ne .Count 1}}s{{end}}</span></p>
+{{range .Matches}}<pre><a href="{{.URL}}">{{.Line}}</a> {{range highlight .}}{{if .Mark}}<mark>{{.Text}}</mark>{{else}}{{.Text}}{{end}}{{end}}</pre>
+{{end}}{{else}}{{if .Searched}}<p class="info">No matches.</p>{{end}}
+{{end}}</body>
+</html>
+`))
+
+// searchHandler serves a page to search build logs, see Search.
+func searchHandler(state *ServerState, w http.ResponseWriter, req *http.Request) {
+	data := map[string]interface{}{
+		"Query":  &SearchQuery{Text: req.FormValue("q"), Repo: req.FormValue("repo"), Branch: req.FormValue("branch"), State: req.FormValue("state")},
+		"States": searchStates,
+		"Since":  req.FormValue("since"),
+		"Until":  req.FormValue("until"),
+	}
+	status := http.StatusOK
+	q, err := searchQueryFromRequest(req)
+	if err == nil && strings.TrimSpace(q.Text) != "" {
+		data["Searched"] = true
+		data["Results"], err = Search(state.config(), q)
+	}
+	if err != nil {
+		var msg string
+		msg, status = toHTTPError(err)
+		data["Error"] = msg
+	}
+
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := searchPageTemplate.Execute(w, data); err != nil {
+		webLog.Errorf("Failed to write search page: %v", err)
+	}
+}